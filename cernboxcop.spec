@@ -30,6 +30,8 @@ mkdir -p %buildroot/usr/local/bin
 mkdir -p %buildroot/etc/cernboxcop
 mkdir -p %buildroot/etc/logrotate.d
 mkdir -p %buildroot/var/log/cernboxcop
+mkdir -p %buildroot/var/cache/cernboxcop
+mkdir -p %buildroot/var/lib/cernboxcop/samples
 install -m 755 cernboxcop %buildroot/usr/local/bin/cernboxcop
 install -m 644 cernboxcop.toml       %buildroot/etc/cernboxcop/cernboxcop.toml
 install -m 644 cernboxcop.logrotate  %buildroot/etc/logrotate.d/cernboxcop
@@ -46,6 +48,8 @@ rm -rf %buildroot/
 /etc/
 /etc/logrotate.d/cernboxcop
 /var/log/cernboxcop
+/var/cache/cernboxcop
+/var/lib/cernboxcop
 /usr/local/bin/*
 %config(noreplace) /etc/cernboxcop/cernboxcop.toml
 
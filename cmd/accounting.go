@@ -6,18 +6,13 @@ import (
 	"fmt"
 	"github.com/cs3org/reva/pkg/eosclient"
 	"github.com/dustin/go-humanize"
-	"github.com/leekchan/accounting"
-	"github.com/mitchellh/mapstructure"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"github.com/tj/go-spin"
 	"gopkg.in/ldap.v3"
-	"io/ioutil"
-	"net/http"
 	"os"
 	"os/user"
 	"path"
-	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -35,13 +30,19 @@ func init() {
 	accountingReportCmd.Flags().IntP("limit", "l", -1, "reports for <n> first projects and <n> first users. -1 means all.")
 	accountingReportCmd.Flags().Bool("charging", false, "obtains charging information from account receiver")
 	accountingReportCmd.Flags().Bool("user-also", false, "computes user home directories also")
+	accountingReportCmd.Flags().StringSliceP("namespace", "n", nil, "namespaces of the eos topology to report, by default the ones with report = true")
 	accountingReportCmd.Flags().Bool("show-invalid", false, "shows projects with invalid information, to be archived/retired because missing user information")
-	accountingReportCmd.Flags().Bool("push-dev", false, "push data to acc-receiver-dev.cern.ch")
-	accountingReportCmd.Flags().Bool("push-eos", false, "store data into /eos/project/f/fdo/www/accounting/data")
-	accountingReportCmd.Flags().Bool("push-prod", false, "push data to acc-receiver.cern.ch")
+	accountingReportCmd.Flags().Bool("push-dev", false, "push data to the dev accounting receiver (receiver_dev_url)")
+	accountingReportCmd.Flags().Bool("push-eos", false, "store data into eos.accounting_dir (/eos/project/f/fdo/www/accounting/data by default)")
+	accountingReportCmd.Flags().Bool("push-prod", false, "push data to the accounting receiver (receiver_url)")
+	accountingReportCmd.Flags().Bool("force-push", false, "push even if the same payload was already pushed for the day")
+	accountingReportCmd.Flags().Bool("allow-incomplete", false, "push data even if some EOS instances could not be queried")
 	accountingReportCmd.Flags().Bool("as-yesterday", false, "useful when computing metrics from previous day. Use when pushing to API after midnight")
 	accountingReportCmd.Flags().StringP("out", "o", ".", "directory to output accounting information")
-	accountingReportCmd.Flags().Float64P("cost", "", 2.20, "cost factor for CHF/TBMonth")
+	accountingReportCmd.Flags().Float64P("cost", "", 2.20, "cost factor for CHF/TBMonth used when cost_model does not define a rate")
+	accountingReportCmd.Flags().Bool("resume", false, "continues the last failed run from its last completed stage (listing, users, quotas, charging)")
+	accountingReportCmd.Flags().StringSlice("group-by", nil, "also writes accounting-agg-<dims>.txt aggregated by these dimensions: chargegroup, chargerole, simplerole, department, instance, accounttype")
+	accountingReportCmd.Flags().Bool("show-overrides", false, "adds an OVERRIDE column to accounting.txt and an OVERRIDES column to the aggregates marking the spaces charged by a charge override")
 }
 
 var accountingCmd = &cobra.Command{
@@ -60,85 +61,183 @@ var accountingReportCmd = &cobra.Command{
 		pushProd, _ := cmd.Flags().GetBool("push-prod")
 		pushDev, _ := cmd.Flags().GetBool("push-dev")
 		pushEOS, _ := cmd.Flags().GetBool("push-eos")
+		forcePush, _ := cmd.Flags().GetBool("force-push")
+		allowIncomplete, _ := cmd.Flags().GetBool("allow-incomplete")
 		asYesterday, _ := cmd.Flags().GetBool("as-yesterday")
 		out, _ := cmd.Flags().GetString("out")
 		factorPerTB, _ := cmd.Flags().GetFloat64("cost")
-		var factorPerByte float64 = factorPerTB / float64(1000000000000)
+		model := getCostModel(factorPerTB)
+		groupBy, _ := cmd.Flags().GetStringSlice("group-by")
+		dims, err := getAggregateDimensions(groupBy)
+		if err != nil {
+			er(err)
+		}
+		showOverrides, _ := cmd.Flags().GetBool("show-overrides")
 
-		infos := getEOSProjects(head)
-		if userAlso {
-			infos = append(infos, getEOSUsers(head)...)
+		charge, _ := cmd.Flags().GetBool("charging")
+		resume, _ := cmd.Flags().GetBool("resume")
+		names, _ := cmd.Flags().GetStringSlice("namespace")
+		namespaces, err := getTopology().reportNamespaces(names, userAlso)
+		if err != nil {
+			er(err)
 		}
+		cp := openCheckpoint("report", resume, head, namespaces, charge)
+		infos, failures := collectInfos(cp, head, conc, namespaces, charge, showInvalid)
 
-		l := getLDAP()
-		defer l.Close()
-		userInfos := getUserInfos(l, infos, conc)
+		files, receiverFile := writeAccountingFiles(infos, out, model, dims, charge, showOverrides, timeNow(asYesterday), failures)
+		if len(failures) > 0 && (pushProd || pushDev) && !allowIncomplete {
+			er("not pushing an incomplete report to the account receiver, use --allow-incomplete to push it anyway")
+		}
+		if charge && (pushProd || pushDev) {
+			url := getReceiverURL(!pushProd)
+			pushed, err := newReceiverClient(url).pushFile(receiverFile, forcePush)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "error pushing data to account receiver:%s %+v\n", url, err)
+				er(err)
+			}
+			if pushed {
+				fmt.Println("Data pushed to " + url)
+			} else {
+				fmt.Println("Data already pushed to " + url + ", use --force-push to push it again")
+			}
+		}
+		if pushEOS {
+			saveToEOS(files...)
+		}
+		cp.done()
+	},
+}
+
+// collectInfos lists the spaces of the namespaces and fills them
+// with owner, quota and, if charge is set, charging information. The result of
+// every stage is saved in cp; when resuming, the stages completed in cp are
+// skipped. EOS instances that could not be queried are returned, the spaces
+// and quotas they hold are missing from infos.
+var collectInfos = func(cp *checkpoint, head, conc int, namespaces []string, charge, showInvalid bool) ([]*projectInfo, []*instanceFailure) {
+	var infos []*projectInfo
+	if cp.completed(stageListing) {
+		infos = cp.infos
+	} else {
+		var failures []*instanceFailure
+		var err error
+		infos, failures, err = getEOSSpaces(namespaces, head)
+		if err != nil {
+			er(err)
+		}
+		cp.fail(failures...)
+		cp.save(stageListing, infos)
+	}
+
+	if !cp.completed(stageUsers) {
+		pool := newLDAPPool()
+		userInfos := getUserInfos(pool, infos, conc)
+		pool.close()
 		fillUserInfos(infos, userInfos)
+		cp.save(stageUsers, infos)
+	}
 
+	if !cp.completed(stageQuotas) {
 		instances := getInstances(infos)
-		quotas := getQuotas(instances...)
+		quotas, failures := getQuotas(instances...)
+		cp.fail(failures...)
 		fillQuotas(infos, quotas)
+		cp.save(stageQuotas, infos)
+	}
 
-		charge, _ := cmd.Flags().GetBool("charging")
-		if charge {
+	if charge {
+		if !cp.completed(stageCharging) {
 			charges := getCharging(infos, conc)
 			fillCharging(infos, charges)
 			fillChargeRoles(infos)
-			infos = cleanInfos(infos, showInvalid)
+			cp.save(stageCharging, infos)
 		}
+		// not checkpointed, so changes to the overrides apply when resuming
+		applyChargeOverrides(infos, loadChargeOverrides())
+		infos = cleanInfos(infos, showInvalid)
+	}
 
-		fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr)
+	printFailures(cp.state.Failures)
+	return infos, cp.state.Failures
+}
+
+// writeAccountingFiles writes the accounting reports into out. Aggregates by
+// charge group and the receiver JSON, dated with date, are only written if
+// charge is set. The columns marking charge overrides are only added if
+// showOverrides is set, as they are not part of the published formats. If
+// some EOS instances failed, they are listed in accounting-incomplete.txt. It
+// returns all the files written and the receiver JSON file.
+var writeAccountingFiles = func(infos []*projectInfo, out string, model *costModel, dims []*aggregateDimension, charge, showOverrides bool, date time.Time, failures []*instanceFailure) (files []string, receiverFile string) {
+	file := path.Join(out, "accounting.txt")
+	files = []string{file} // all files that are going to be generated
+	computeBasic(infos, file, model, showOverrides)
+	fmt.Printf("%s\n", file)
+	if len(failures) > 0 {
+		file := path.Join(out, "accounting-incomplete.txt")
+		files = append(files, file)
+		computeIncomplete(failures, file)
+		fmt.Printf("%s\n", file)
+	}
+	if len(dims) > 0 {
+		names := make([]string, 0, len(dims))
+		for _, d := range dims {
+			names = append(names, d.name)
+		}
+		file := path.Join(out, fmt.Sprintf("accounting-agg-%s.txt", strings.Join(names, "-")))
+		files = append(files, file)
+		writeAggregate(infos, file, model, showOverrides, dims...)
+		fmt.Printf("%s\n", file)
+	}
+	if charge {
+		file := path.Join(out, "accounting-agg-groups.txt")
+		files = append(files, file)
+		computeAggregateToGroups(infos, file, model, showOverrides)
+		fmt.Printf("%s\n", file)
 
-		file := path.Join(out, "accounting.txt")
-		files := []string{file} // all files that are going to be generated
-		computeBasic(infos, file, factorPerByte)
+		file = path.Join(out, "accounting-agg.txt")
+		files = append(files, file)
+		computeAggregate(infos, file, model, showOverrides)
 		fmt.Printf("%s\n", file)
-		if charge {
-			file := path.Join(out, "accounting-agg-groups.txt")
-			files = append(files, file)
-			computeAggregateToGroups(infos, path.Join(out, "accounting-agg-groups.txt"), factorPerByte)
-			fmt.Printf("%s\n", file)
-
-			file = path.Join(out, "accounting-agg.txt")
-			files = append(files, file)
-			computeAggregate(infos, file, factorPerByte)
-			fmt.Printf("%s\n", file)
-
-			file = path.Join(out, "accounting-agg-simple.txt")
-			files = append(files, file)
-			computeAggregateSimplified(infos, file, factorPerByte)
-			fmt.Printf("%s\n", file)
-
-			file = path.Join(out, "accounting-json-accreceiver.json")
-			files = append(files, file)
-			computeAggregateReceiverJSON(infos, file, asYesterday)
-			fmt.Printf("%s\n", file)
-
-			//  curl -X POST -H "Content-Type: application/json" -H "API-Key:xyz"  https://acc-receiver-dev.cern.ch/v2/fe/cernbox
-			if pushProd {
-				url := "https://acc-receiver.cern.ch/v2/fe/" + FE
-				pushData(url, file)
-				fmt.Println("Data pushed to " + url)
-			} else if pushDev {
-				url := "https://acc-receiver-dev.cern.ch/v2/fe/" + FE
-				pushData(url, file)
-				fmt.Println("Data pushed to " + url)
-			}
 
-		}
-		if pushEOS {
-			saveToEOS(files...)
-		}
-	},
+		file = path.Join(out, "accounting-agg-simple.txt")
+		files = append(files, file)
+		computeAggregateSimplified(infos, file, model, showOverrides)
+		fmt.Printf("%s\n", file)
+
+		receiverFile = path.Join(out, "accounting-json-accreceiver.json")
+		files = append(files, receiverFile)
+		computeAggregateReceiverJSON(infos, receiverFile, date)
+		fmt.Printf("%s\n", receiverFile)
+	}
+	return
+}
+
+// overrideMarker flags spaces charged by a charge override, with its reason.
+func overrideMarker(p *projectInfo) string {
+	if p.chargeInfo.Override == "" {
+		return ""
+	}
+	return "* " + strings.Join(strings.Fields(p.chargeInfo.Override), " ")
+}
+
+var computeIncomplete = func(failures []*instanceFailure, file string) {
+	cols := []string{"INSTANCE", "OPERATION", "ERROR"}
+	rows := [][]string{}
+	for _, f := range failures {
+		rows = append(rows, []string{f.Instance, f.Operation, f.Message})
+	}
+	save(cols, rows, file)
 }
 
 // storage files into cernbox project in EOS
 var saveToEOS = func(files ...string) {
 	ctx := getCtx()
-	client := getEOS("root://eosproject-f.cern.ch")
+	t := getTopology()
+	client := getEOS(t.resolve(t.AccountingMGM))
 	key := time.Now().Local().Format("2006/01/02")
-	ctx, _ = context.WithTimeout(ctx, time.Second*30)
-	dir := "/eos/project/f/fdo/www/accounting/data/cernbox/"
+	ctx, cancel := context.WithTimeout(ctx, time.Second*30)
+	defer cancel()
+	dir := t.AccountingDir
 	err := client.CreateDir(ctx, "ml001", path.Join(dir, key))
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "error creating accounting directory in EOS: %+v\n", err)
@@ -172,92 +271,19 @@ var timeNow = func(asYesterday bool) time.Time {
 	return t
 }
 
-var pushData = func(endpoint, file string) {
-	client := &http.Client{}
-	data, err := ioutil.ReadFile(file)
-	if err != nil {
-
-		log.Error().Msgf("error pushing data to:%s err:%+v", endpoint, file, err)
-		er(err)
-	}
-	req, err := http.NewRequest("POST", endpoint, strings.NewReader(string(data)))
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Content-Length", fmt.Sprintf("%d", len(data)))
-	key := viper.GetString("receiver_api_key")
-	req.Header.Set("API-Key", key)
-	resp, err := client.Do(req)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "error pushing data to account receiver:%s %+v\n", endpoint, err)
-		er(err)
-	}
-	defer resp.Body.Close()
-	result, _ := ioutil.ReadAll(resp.Body)
-	if resp.StatusCode != http.StatusOK {
-		fmt.Fprintf(os.Stderr, "error pushing data to account receiver:%s %+v\n", endpoint, string(result))
-
-	}
-	log.Info().Msgf("Results from pushing data to receiver service: %s\n", string(result))
-
-}
-
-var getCost = func(bytes int, factorCost float64) string {
-	ac := accounting.Accounting{Symbol: "CHF", Precision: 2}
-	return ac.FormatMoney(factorCost * float64(bytes))
-}
-
-var computeAggregateReceiverJSON = func(infos []*projectInfo, file string, asYesterday bool) {
-	infos = uniqueInfos(infos)
-	aggregate := map[string]map[string]eosclient.QuotaInfo{}
-	for _, info := range infos {
-		group := info.chargeInfo.ChargeGroup
-		role := info.chargeInfo.ChargeRole
-		roles, ok := aggregate[group]
-		if !ok {
-			aggregate[group] = map[string]eosclient.QuotaInfo{
-				role: *info.QuotaInfo,
-			}
-		}
-
-		// here we have the group, we don't know if we have the role
-		if _, ok := roles[role]; !ok {
-			aggregate[group][role] = *info.QuotaInfo
-
-		}
-
-		// at this point we are sure we have the group and the role
-		quota, _ := aggregate[group][role]
-		quota.AvailableBytes += info.QuotaInfo.AvailableBytes
-		quota.UsedBytes += info.QuotaInfo.UsedBytes
-
-	}
-
+var computeAggregateReceiverJSON = func(infos []*projectInfo, file string, date time.Time) {
 	payload := []*accReceiverJSON{}
-	for group, roles := range aggregate {
-		for role, quota := range roles {
-			/*
-				DiskUsage            int
-				DiskQuota            int
-				Date                 string
-				MessageFormatVersion int
-				WallClockHours       int
-				Dedicated            bool
-				ChargeGroup          string
-				ChargeRole           string
-				CPUHours             int
-				FE                   string
-			*/
-
-			j := &accReceiverJSON{
-				DiskUsage:            quota.UsedBytes,
-				DiskQuota:            quota.AvailableBytes,
-				Date:                 timeNow(asYesterday).Format("2006-01-02"),
-				MessageFormatVersion: 2,
-				ChargeGroup:          group,
-				ChargeRole:           role,
-				FE:                   FE,
-			}
-			payload = append(payload, j)
+	for _, agg := range aggregate(infos, nil, dimChargeGroup, dimChargeRole) {
+		j := &accReceiverJSON{
+			DiskUsage:            agg.quota.UsedBytes,
+			DiskQuota:            agg.quota.AvailableBytes,
+			Date:                 date.Format("2006-01-02"),
+			MessageFormatVersion: 2,
+			ChargeGroup:          agg.keys[0],
+			ChargeRole:           agg.keys[1],
+			FE:                   FE,
 		}
+		payload = append(payload, j)
 	}
 
 	data, err := json.Marshal(payload)
@@ -267,7 +293,7 @@ var computeAggregateReceiverJSON = func(infos []*projectInfo, file string, asYes
 
 	saveWith(file, data)
 }
-var computeBasic = func(infos []*projectInfo, file string, costFactor float64) {
+var computeBasic = func(infos []*projectInfo, file string, model *costModel, showOverrides bool) {
 	cols := []string{
 		"UID",
 		"GID",
@@ -290,6 +316,9 @@ var computeBasic = func(infos []*projectInfo, file string, costFactor float64) {
 		"CHARGEROLE",
 		"COSTH",
 	}
+	if showOverrides {
+		cols = append(cols, "OVERRIDE")
+	}
 
 	rows := [][]string{}
 	for _, p := range infos {
@@ -313,7 +342,10 @@ var computeBasic = func(infos []*projectInfo, file string, costFactor float64) {
 			p.chargeInfo.Type,
 			p.chargeInfo.ChargeGroup,
 			p.chargeInfo.ChargeRole,
-			getCost(p.QuotaInfo.UsedBytes, costFactor),
+			model.format(model.cost(newCostInput(p))),
+		}
+		if showOverrides {
+			row = append(row, overrideMarker(p))
 		}
 		rows = append(rows, row)
 	}
@@ -340,235 +372,25 @@ var cleanInfos = func(infos []*projectInfo, showInvalid bool) []*projectInfo {
 	return clean
 }
 
-var computeAggregateToGroups = func(infos []*projectInfo, file string, costFactor float64) {
-	infos = uniqueInfos(infos)
-	aggregate := map[string]eosclient.QuotaInfo{}
-	for _, info := range infos {
-		group := info.chargeInfo.ChargeGroup
-		quota, ok := aggregate[group]
-		if !ok {
-			aggregate[group] = *info.QuotaInfo
-
-		}
-
-		quota = aggregate[group]
-		quota.AvailableBytes += info.QuotaInfo.AvailableBytes
-		quota.UsedBytes += info.QuotaInfo.UsedBytes
-		aggregate[group] = quota
-
-	}
-
-	// sort by charge groups
-	keys := make([]string, 0, len(aggregate))
-	for k := range aggregate {
-		keys = append(keys, k)
-	}
-	sort.Strings(keys)
-
-	cols := []string{
-		"MAXBYTES",
-		"USEDBYTES",
-		"MAXBYTESH",
-		"USEDBYTESH",
-		"CREATED",
-		"CHARGEGROUP",
-		"COSTH",
-	}
-
-	rows := [][]string{}
-	for _, group := range keys {
-		quota, _ := aggregate[group]
-		created := time.Now().Local().Format("2006-01-02")
-		row := []string{
-			fmt.Sprintf("%d", quota.AvailableBytes),
-			fmt.Sprintf("%d", quota.UsedBytes),
-			humanQuota(quota.AvailableBytes),
-			humanQuota(quota.UsedBytes),
-			created,
-			group,
-			getCost(quota.UsedBytes, costFactor),
-		}
-		rows = append(rows, row)
-	}
-
-	save(cols, rows, file)
+var computeAggregateToGroups = func(infos []*projectInfo, file string, model *costModel, showOverrides bool) {
+	writeAggregate(infos, file, model, showOverrides, dimChargeGroup)
 }
 
-var uniqueInfos = func(infos []*projectInfo) (uniq []*projectInfo) {
-	keys := map[string]*projectInfo{}
-	for _, info := range infos {
-		key := fmt.Sprintf("%s-%d-%d", info.Account, info.QuotaInfo.AvailableBytes, info.QuotaInfo.UsedBytes)
-		keys[key] = info
-	}
-
-	for _, info := range keys {
-		uniq = append(uniq, info)
-	}
-
-	return
+var computeAggregateSimplified = func(infos []*projectInfo, file string, model *costModel, showOverrides bool) {
+	// the published accounting-agg-simplified.txt names the simple role CHARGEROLE
+	simpleRole := &aggregateDimension{dimSimpleRole.name, "CHARGEROLE", dimSimpleRole.value}
+	writeAggregate(infos, file, model, showOverrides, dimChargeGroup, simpleRole)
 }
 
-var computeAggregateSimplified = func(infos []*projectInfo, file string, costFactor float64) {
-	// remove duplicate quota entries
-	infos = uniqueInfos(infos)
-	aggregate := map[string]map[string]eosclient.QuotaInfo{}
-	for _, info := range infos {
-		group := info.chargeInfo.ChargeGroup
-		role := info.chargeInfo.ChargeRole
-		if strings.HasPrefix(role, "CERNBox Project") {
-			role = "CERNBox Project Spaces"
-		} else if strings.Contains(role, "Account") {
-			role = "CERNBox Home Directories"
-		} else {
-			role = "Unknown"
-		}
-
-		roles, ok := aggregate[group]
-		if !ok {
-			aggregate[group] = map[string]eosclient.QuotaInfo{
-				role: *info.QuotaInfo,
-			}
-		}
-
-		// here we have the group, we don't know if we have the role
-		if _, ok := roles[role]; !ok {
-			aggregate[group][role] = *info.QuotaInfo
-
-		}
-
-		// at this point we are sure we have the group and the role
-		quota, _ := aggregate[group][role]
-		quota.AvailableBytes += info.QuotaInfo.AvailableBytes
-		quota.UsedBytes += info.QuotaInfo.UsedBytes
-		aggregate[group][role] = quota
-
-	}
-
-	// sort by charge groups
-	keys := make([]string, 0, len(aggregate))
-	for k := range aggregate {
-		keys = append(keys, k)
-	}
-	sort.Strings(keys)
-
-	cols := []string{
-		"MAXBYTES",
-		"USEDBYTES",
-		"MAXBYTESH",
-		"USEDBYTESH",
-		"CREATED",
-		"CHARGEGROUP",
-		"CHARGEROLE",
-		"COSTH",
-	}
-
-	rows := [][]string{}
-	for _, group := range keys {
-		roles, _ := aggregate[group]
-		keys := make([]string, 0, len(roles))
-		for k := range roles {
-			keys = append(keys, k)
-		}
-		sort.Strings(keys)
-
-		for _, role := range keys {
-			quota, _ := roles[role]
-			created := time.Now().Local().Format("2006-01-02")
-			row := []string{
-				fmt.Sprintf("%d", quota.AvailableBytes),
-				fmt.Sprintf("%d", quota.UsedBytes),
-				humanQuota(quota.AvailableBytes),
-				humanQuota(quota.UsedBytes),
-				created,
-				group,
-				role,
-				getCost(quota.UsedBytes, costFactor),
-			}
-			rows = append(rows, row)
-		}
-	}
-
-	save(cols, rows, file)
-
-}
-var computeAggregate = func(infos []*projectInfo, file string, costFactor float64) {
-	aggregate := map[string]map[string]eosclient.QuotaInfo{}
-	for _, info := range infos {
-		group := info.chargeInfo.ChargeGroup
-		role := info.chargeInfo.ChargeRole
-		roles, ok := aggregate[group]
-		if !ok {
-			aggregate[group] = map[string]eosclient.QuotaInfo{
-				role: *info.QuotaInfo,
-			}
-		}
-
-		// here we have the group, we don't know if we have the role
-		if _, ok := roles[role]; !ok {
-			aggregate[group][role] = *info.QuotaInfo
-
-		}
-
-		// at this point we are sure we have the group and the role
-		quota, _ := aggregate[group][role]
-		quota.AvailableBytes += info.QuotaInfo.AvailableBytes
-		quota.UsedBytes += info.QuotaInfo.UsedBytes
-
-	}
-
-	// sort by charge groups
-	keys := make([]string, 0, len(aggregate))
-	for k := range aggregate {
-		keys = append(keys, k)
-	}
-	sort.Strings(keys)
-
-	cols := []string{
-		"MAXBYTES",
-		"USEDBYTES",
-		"MAXBYTESH",
-		"USEDBYTESH",
-		"CREATED",
-		"CHARGEGROUP",
-		"CHARGEROLE",
-		"COSTH",
-	}
-
-	rows := [][]string{}
-	for _, group := range keys {
-		roles, _ := aggregate[group]
-		keys := make([]string, 0, len(roles))
-		for k := range roles {
-			keys = append(keys, k)
-		}
-		sort.Strings(keys)
-
-		for _, role := range keys {
-			quota, _ := roles[role]
-			created := time.Now().Local().Format("2006-01-02")
-			row := []string{
-				fmt.Sprintf("%d", quota.AvailableBytes),
-				fmt.Sprintf("%d", quota.UsedBytes),
-				humanQuota(quota.AvailableBytes),
-				humanQuota(quota.UsedBytes),
-				created,
-				group,
-				role,
-				getCost(quota.UsedBytes, costFactor),
-			}
-			rows = append(rows, row)
-		}
-	}
-
-	save(cols, rows, file)
-
+var computeAggregate = func(infos []*projectInfo, file string, model *costModel, showOverrides bool) {
+	writeAggregate(infos, file, model, showOverrides, dimChargeGroup, dimChargeRole)
 }
 
 // cleans roles and groups
 var fillChargeRoles = func(infos []*projectInfo) {
 	for _, info := range infos {
-		if strings.HasPrefix(info.FileInfo.File, "/eos/project/") {
-			info.chargeInfo.ChargeRole = "CERNBox Project " + path.Base(info.FileInfo.File)
+		if ns := getTopology().namespaceOfPath(info.FileInfo.File); ns != nil {
+			info.chargeInfo.ChargeRole = ns.chargeRole(info)
 		} else {
 			info.chargeInfo.ChargeRole = info.userInfo.accountTypeHuman()
 		}
@@ -584,7 +406,7 @@ var fillChargeRoles = func(infos []*projectInfo) {
 	}
 }
 
-var getUserInfos = func(lc *ldap.Conn, infos []*projectInfo, concurrency int) map[uint64]*userInfo {
+var getUserInfos = func(pool *ldapPool, infos []*projectInfo, concurrency int) map[uint64]*userInfo {
 	var throttle = make(chan int, concurrency)
 	var wg sync.WaitGroup
 
@@ -602,28 +424,50 @@ var getUserInfos = func(lc *ldap.Conn, infos []*projectInfo, concurrency int) ma
 				<-throttle
 			}()
 
-			ui := getUserInfo(lc, p.FileInfo.UID)
+			ui := getUserInfo(pool, p.FileInfo.UID)
 			mux.Lock()
 			defer mux.Unlock()
 			m[p.FileInfo.UID] = ui
 			fmt.Fprintf(os.Stderr, "\r %s Getting account info [%d/%d]", s.Next(), i, l)
 		}(i, s, p, &wg, throttle)
 	}
-	fmt.Fprintln(os.Stderr)
 	wg.Wait()
+	fmt.Fprintln(os.Stderr)
+	pool.printFailures()
 	return m
 }
 
-var getUserInfo = func(lc *ldap.Conn, uid uint64) *userInfo {
+var getUserInfo = func(pool *ldapPool, uid uint64) *userInfo {
 	username, err := getUsername(uid)
 	if err != nil {
 		// we don't fill user info
 		return newUserInfo()
 	}
 
-	ui := getUserFull(lc, username)
+	ui, _ := getAccountInfo(pool, username)
 	return ui
+}
+
+// getAccountInfo looks up username and its owner in LDAP, using the cache.
+// An account that does not exist returns an empty userInfo and no error.
+var getAccountInfo = func(pool *ldapPool, username string) (*userInfo, error) {
+	cached := &cachedUserInfo{}
+	if getCache().get(cacheBucketUser, username, cached) {
+		return cached.userInfo(), nil
+	}
 
+	var ui *userInfo
+	err := pool.do(username, func(l *ldap.Conn) (err error) {
+		ui, err = lookupUserFull(l, username)
+		return
+	})
+	if ui == nil { // LDAP could not be reached
+		ui = newUserInfo()
+	}
+	if err == nil && ui.Account != "" {
+		getCache().set(cacheBucketUser, username, newCachedUserInfo(ui))
+	}
+	return ui, err
 }
 
 var getInstances = func(infos []*projectInfo) []string {
@@ -646,30 +490,27 @@ var getInstances = func(infos []*projectInfo) []string {
 var getCharging = func(infos []*projectInfo, concurrency int) map[string]*chargeInfo {
 	// obtain list of usernames
 	// and send them in a big JSON document
+	// accounts already in the local cache are not asked again
+	charges := map[string]*chargeInfo{}
 	accounts := make([]string, 0, len(infos))
 	for _, v := range infos {
+		ci := &chargeInfo{}
+		if getCache().get(cacheBucketCharge, v.userInfo.Account, ci) {
+			charges[v.userInfo.Account] = ci
+			continue
+		}
 		accounts = append(accounts, v.userInfo.Account)
 	}
 
 	// chunk requests so we don't get gateway timeouts
-	chunks := [][]string{}
-	chunkSize := 1000
-	for i := 0; i < len(accounts); i += chunkSize {
-		end := i + chunkSize
+	chunks := chunkAccounts(accounts, 1000)
 
-		if end > len(accounts) {
-			end = len(accounts)
-		}
-
-		chunks = append(chunks, accounts[i:end])
-	}
-
-	charges := map[string]*chargeInfo{}
 	mux := sync.Mutex{}
+	client := newReceiverClient("")
+	failed := 0
 
 	var throttle = make(chan int, 1)
 	var wg sync.WaitGroup
-	url := "https://accounting-receiver.cern.ch/v2/"
 	s := spin.New()
 	counter := uint64(0)
 	totalAccounts := len(accounts)
@@ -677,71 +518,52 @@ var getCharging = func(infos []*projectInfo, concurrency int) map[string]*charge
 		throttle <- 1 // whatever number
 		wg.Add(1)
 		go func(accounts []string, wg *sync.WaitGroup, throttle chan int) {
-			client := &http.Client{}
 			atomic.AddUint64(&counter, uint64(len(accounts)))
 			defer wg.Done()
 			defer func() {
 				<-throttle
 			}()
-			ch := &chargeJSON{Users: accounts}
-			body, err := json.Marshal(ch)
-			if err != nil {
-				er(err)
-			}
-
-			req, err := http.NewRequest("GET", url, strings.NewReader(string(body)))
-			req.Header.Set("Content-Type", "application/json")
-			resp, err := client.Do(req)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "error GETing account receiver: %+v", err)
-				er(err)
-			}
-			defer resp.Body.Close()
 
-			if resp.StatusCode != http.StatusOK {
-				er(fmt.Sprintf("error GETing account received, HTTP error code: %+v", resp.StatusCode))
-			}
-
-			body, err = ioutil.ReadAll(resp.Body)
+			// accounts of failed chunks keep an Unknown charge group instead of aborting the report
+			cis, err := client.charging(accounts)
 			if err != nil {
-				er(err)
-			}
-			cr := chargeResponse{}
-			if err := json.Unmarshal(body, &cr); err != nil {
-				log.Error().Msgf("error parsing account receiver: %+v", err)
-				er(err)
+				log.Error().Msgf("error GETing account receiver: accounts:%d err:%+v", len(accounts), err)
+				mux.Lock()
+				failed += len(accounts)
+				mux.Unlock()
+				return
 			}
 
-			log.Info().Msgf("Charge info: sent:%d got:%d")
 			fmt.Fprintf(os.Stderr, "\r %s Resolving charging information [%d/%d]", s.Next(), counter, totalAccounts)
-			for k, v := range cr {
-				ci := &chargeInfo{}
-				if err := mapstructure.Decode(v, ci); err != nil {
-					log.Error().Msgf("error decoding: account:%s value:%s", k, v)
-					continue
-				}
-				// validate input
-				// TODO(labkode): report that the API returns charge type with whitespaces at the beggining.
-				ci.Type = strings.TrimSpace(ci.Type)
-				ci.ChargeGroup = strings.TrimSpace(ci.ChargeGroup)
-				log.Info().Msgf("charge info for account: %s %+v", k, ci)
-
-				mux.Lock()
+			mux.Lock()
+			for k, ci := range cis {
 				charges[k] = ci
-				mux.Unlock()
+				getCache().set(cacheBucketCharge, k, ci)
 			}
+			mux.Unlock()
 
 		}(accounts, &wg, throttle)
 	}
 	wg.Wait()
+	if failed > 0 {
+		fmt.Fprintf(os.Stderr, "\n%d accounts could not be resolved by the account receiver, their charge information will be Unknown\n", failed)
+	}
 	return charges
 }
 
-type chargeJSON struct {
-	Users []string `json:"users"`
-}
+var chunkAccounts = func(accounts []string, chunkSize int) [][]string {
+	chunks := [][]string{}
+	for i := 0; i < len(accounts); i += chunkSize {
+		end := i + chunkSize
 
-type chargeResponse map[string]interface{}
+		if end > len(accounts) {
+			end = len(accounts)
+		}
+
+		chunks = append(chunks, accounts[i:end])
+	}
+	return chunks
+}
 
 var fillCharging = func(infos []*projectInfo, charges map[string]*chargeInfo) {
 	s := spin.New()
@@ -785,71 +607,87 @@ var fillUserInfos = func(infos []*projectInfo, uis map[uint64]*userInfo) {
 
 var getUsername = func(uid uint64) (string, error) {
 	uidstr := fmt.Sprintf("%d", uid)
+	var username string
+	if getCache().get(cacheBucketUID, uidstr, &username) {
+		return username, nil
+	}
+
 	u, err := user.LookupId(uidstr)
 	if err != nil {
 		return "", err
 	}
+	getCache().set(cacheBucketUID, uidstr, u.Username)
 	return u.Username, nil
 }
 
-var getEOSUsers = func(limit int) (infos []*projectInfo) {
-	ctx := getCtx()
-	var mds []*eosclient.FileInfo
-	letters := "abcdefghijklmnopqrstuvwxyz"
-	s := spin.New()
-	for i := 0; i < len(letters); i++ {
-		letter := string(letters[i])
-		fmt.Fprintf(os.Stderr, "\r %s Getting users [%s]", s.Next(), letter)
-		host := fmt.Sprintf("root://eoshome-%s.cern.ch", letter)
-		client := getEOS(host)
-		ctx, _ := context.WithTimeout(ctx, time.Second*30)
-		m, err := client.List(ctx, "root", "/eos/user/"+letter)
+// getEOSSpaces lists the spaces of the given namespaces, up to limit per namespace.
+// An error is returned if a namespace is not in the topology.
+var getEOSSpaces = func(namespaces []string, limit int) ([]*projectInfo, []*instanceFailure, error) {
+	infos := []*projectInfo{}
+	failures := []*instanceFailure{}
+	for _, ns := range namespaces {
+		mds, f, err := listEOSSpaces(ns)
 		if err != nil {
-			er(err)
+			return nil, nil, err
 		}
-		mds = append(mds, m...)
+		infos = append(infos, newProjectInfos(mds, limit)...)
+		failures = append(failures, f...)
 	}
-	fmt.Fprintln(os.Stderr)
+	return infos, failures, nil
+}
 
-	if limit == -1 {
-		limit = len(mds)
+// listEOSSpaces lists the top directories of a namespace sharded by letter, one instance per letter,
+// as configured in the eos topology. Instances are listed concurrently, the ones that fail are
+// skipped and returned.
+var listEOSSpaces = func(namespace string) ([]*eosclient.FileInfo, []*instanceFailure, error) {
+	t := getTopology()
+	ns := t.namespace(namespace)
+	if ns == nil {
+		return nil, nil, fmt.Errorf("eos topology: no %s namespace", namespace)
 	}
 
-	for i, m := range mds {
-		if i > limit {
-			break
+	hosts := []string{}
+	dirs := map[string][]string{}
+	for _, letter := range ns.letters() {
+		host := t.mgm(ns, letter)
+		if _, ok := dirs[host]; !ok {
+			hosts = append(hosts, host)
 		}
+		// several letters can be served by the same instance
+		dirs[host] = append(dirs[host], ns.dir(letter))
+	}
 
-		// ctime
-		ctimestr := strings.Split(m.Attrs["ctime"], ".")[0]
-		ctime, _ := strconv.ParseInt(ctimestr, 10, 64)
-		t := time.Unix(ctime, 0)
+	var mu sync.Mutex
+	listed := map[string][]*eosclient.FileInfo{}
+	failures := eachInstance("Listing "+namespace+" spaces", hosts, func(host string) error {
+		for _, dir := range dirs[host] {
+			m, err := listEOSDir(host, dir)
+			if err != nil {
+				return err
+			}
+			mu.Lock()
+			listed[host] = append(listed[host], m...)
+			mu.Unlock()
+		}
+		return nil
+	})
 
-		pi := &projectInfo{FileInfo: m, userInfo: newUserInfo(), QuotaInfo: &eosclient.QuotaInfo{}, chargeInfo: chargeInfo{}, created: t}
-		infos = append(infos, pi)
+	// keep the order of the letters so limits and reports are stable
+	mds := []*eosclient.FileInfo{}
+	for _, host := range hosts {
+		mds = append(mds, listed[host]...)
 	}
+	return mds, failures, nil
+}
 
-	return
+var listEOSDir = func(mgm, dir string) ([]*eosclient.FileInfo, error) {
+	ctx, cancel := context.WithTimeout(getCtx(), viper.GetDuration("eos_list_timeout"))
+	defer cancel()
+	client := getEOS(mgm)
+	return client.List(ctx, "root", dir)
 }
-var getEOSProjects = func(limit int) (infos []*projectInfo) {
-	ctx := getCtx()
-	var mds []*eosclient.FileInfo
-	letters := "abcdefghijklmnopqrstuvwxyz"
-	s := spin.New()
-	for i := 0; i < len(letters); i++ {
-		letter := string(letters[i])
-		fmt.Fprintf(os.Stderr, "\r %s Getting project names [%s]", s.Next(), letter)
-		host := fmt.Sprintf("root://eosproject-%s.cern.ch", letter)
-		client := getEOS(host)
-		ctx, _ := context.WithTimeout(ctx, time.Second*30)
-		m, err := client.List(ctx, "root", "/eos/project/"+letter)
-		if err != nil {
-			er(err)
-		}
-		mds = append(mds, m...)
-	}
-	fmt.Fprintln(os.Stderr)
 
+var newProjectInfos = func(mds []*eosclient.FileInfo, limit int) (infos []*projectInfo) {
 	if limit == -1 {
 		limit = len(mds)
 	}
@@ -889,31 +727,53 @@ type chargeInfo struct {
 	Owner       string `json:"owner" mapstructure:"owner"`
 	ChargeGroup string `json:"charge_group" mapstructure:"charge_group"`
 	ChargeRole  string `json:"charge_role" mapstructure:"charge_role"`
+	Override    string `json:"override,omitempty" mapstructure:"-"` // reason of the charge override applied, if any
 }
 
 type chargeInfoSchema map[string]*chargeInfo
 
-func getQuotas(mgms ...string) map[string]*eosclient.QuotaInfo {
+// getQuotas dumps the quotas of the instances concurrently. Instances that
+// fail are skipped and returned.
+func getQuotas(mgms ...string) (map[string]*eosclient.QuotaInfo, []*instanceFailure) {
+	var mu sync.Mutex
 	quotas := map[string]*eosclient.QuotaInfo{}
-	s := spin.New()
-	for _, mgm := range mgms {
-		fmt.Fprintf(os.Stderr, "\r %s Getting quota for instance: %s", s.Next(), mgm)
-		ctx, _ := context.WithTimeout(getCtx(), time.Second*60)
-		eos := getEOS(mgm)
-		prefix := "/eos/project/"
-		if strings.Contains(mgm, "home") {
-			prefix = "/eos/user/"
-		}
-		qts, err := eos.DumpQuotas(ctx, prefix)
+	failures := eachInstance("Getting quotas", mgms, func(mgm string) error {
+		qts, err := dumpQuotas(mgm)
 		if err != nil {
-			er(err)
+			return err
 		}
+		mu.Lock()
 		for k, v := range qts {
-			k += mgm
 			quotas[k] = v
 		}
+		mu.Unlock()
+		return nil
+	})
+	return quotas, failures
+}
+
+// dumpQuotas returns the quota nodes of an instance keyed by account and instance,
+// as expected by fillQuotas.
+var dumpQuotas = func(mgm string) (map[string]*eosclient.QuotaInfo, error) {
+	ctx, cancel := context.WithTimeout(getCtx(), viper.GetDuration("eos_quota_timeout"))
+	defer cancel()
+	eos := getEOS(mgm)
+	namespaces := getTopology().namespacesOf(mgm)
+	if len(namespaces) == 0 {
+		return nil, fmt.Errorf("instance %s is not in the eos topology", mgm)
+	}
+
+	quotas := map[string]*eosclient.QuotaInfo{}
+	for _, ns := range namespaces {
+		qts, err := eos.DumpQuotas(ctx, ns.QuotaPrefix)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range qts {
+			quotas[k+mgm] = v
+		}
 	}
-	return quotas
+	return quotas, nil
 }
 
 /*
@@ -0,0 +1,245 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/cs3org/reva/pkg/eosclient"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+func init() {
+	viper.SetDefault("samples_dir", "/var/lib/cernboxcop/samples")
+
+	accountingCmd.AddCommand(accountingSampleCmd)
+	accountingCmd.AddCommand(accountingAverageCmd)
+
+	accountingSampleCmd.Flags().IntP("concurrency", "c", 200, "use up to <n> concurrent connections to retrive information from external services (LDAP)")
+	accountingSampleCmd.Flags().IntP("limit", "l", -1, "samples <n> first projects and <n> first users. -1 means all.")
+	accountingSampleCmd.Flags().Bool("charging", true, "obtains charging information from account receiver")
+	accountingSampleCmd.Flags().Bool("user-also", false, "samples user home directories also")
+	accountingSampleCmd.Flags().StringSliceP("namespace", "n", nil, "namespaces of the eos topology to sample, by default the ones with report = true")
+	accountingSampleCmd.Flags().Bool("resume", false, "continues the last failed sample from its last completed stage (listing, users, quotas, charging)")
+
+	accountingAverageCmd.Flags().StringP("period", "p", time.Now().Local().AddDate(0, -1, 0).Format("2006-01"), "billing period to average (YYYY-MM)")
+	accountingAverageCmd.Flags().StringP("out", "o", ".", "directory to output accounting information")
+	accountingAverageCmd.Flags().Float64P("cost", "", 2.20, "cost factor for CHF/TBMonth used when cost_model does not define a rate")
+	accountingAverageCmd.Flags().StringSlice("group-by", nil, "also writes accounting-agg-<dims>.txt aggregated by these dimensions: chargegroup, chargerole, simplerole, department, instance, accounttype")
+	accountingAverageCmd.Flags().Bool("show-invalid", false, "shows projects with invalid information, to be archived/retired because missing user information")
+	accountingAverageCmd.Flags().String("date", "", "date of the receiver JSON records (YYYY-MM-DD), by default the last day of the period")
+	accountingAverageCmd.Flags().Bool("show-overrides", false, "adds an OVERRIDE column to accounting.txt and an OVERRIDES column to the aggregates marking the spaces charged by a charge override")
+}
+
+var accountingSampleCmd = &cobra.Command{
+	Use:   "sample",
+	Short: "Stores a sample of the current quotas into samples_dir, to be run daily",
+	Run: func(cmd *cobra.Command, args []string) {
+		head, _ := cmd.Flags().GetInt("limit")
+		conc, _ := cmd.Flags().GetInt("concurrency")
+		userAlso, _ := cmd.Flags().GetBool("user-also")
+		charge, _ := cmd.Flags().GetBool("charging")
+		resume, _ := cmd.Flags().GetBool("resume")
+		names, _ := cmd.Flags().GetStringSlice("namespace")
+		namespaces, err := getTopology().reportNamespaces(names, userAlso)
+		if err != nil {
+			er(err)
+		}
+		cp := openCheckpoint("sample", resume, head, namespaces, charge)
+
+		// invalid entries are kept, they are filtered when averaging
+		infos, failures := collectInfos(cp, head, conc, namespaces, charge, true)
+
+		now := time.Now().Local()
+		sample := &accountingSample{Time: now, Records: newInfoRecords(infos), Failures: failures}
+		file := path.Join(viper.GetString("samples_dir"), now.Format("2006-01-02")+".json")
+		if err := saveJSON(file, sample); err != nil {
+			er(err)
+		}
+		cp.done()
+		fmt.Println(file)
+	},
+}
+
+var accountingAverageCmd = &cobra.Command{
+	Use:   "average",
+	Short: "Computes the accounting reports from the time-weighted average usage of a billing period",
+	Run: func(cmd *cobra.Command, args []string) {
+		period, _ := cmd.Flags().GetString("period")
+		out, _ := cmd.Flags().GetString("out")
+		factorPerTB, _ := cmd.Flags().GetFloat64("cost")
+		showInvalid, _ := cmd.Flags().GetBool("show-invalid")
+		dateStr, _ := cmd.Flags().GetString("date")
+		groupBy, _ := cmd.Flags().GetStringSlice("group-by")
+		dims, err := getAggregateDimensions(groupBy)
+		if err != nil {
+			er(err)
+		}
+		showOverrides, _ := cmd.Flags().GetBool("show-overrides")
+		model := getCostModel(factorPerTB)
+
+		start, err := time.ParseInLocation("2006-01", period, time.Local)
+		if err != nil {
+			er(fmt.Sprintf("invalid period %q, expected YYYY-MM", period))
+		}
+		end := start.AddDate(0, 1, 0)
+		if now := time.Now().Local(); now.Before(end) {
+			end = now
+		}
+
+		date := end.AddDate(0, 0, -1)
+		if dateStr != "" {
+			if date, err = time.ParseInLocation("2006-01-02", dateStr, time.Local); err != nil {
+				er(err)
+			}
+		}
+
+		samples := loadSamples(viper.GetString("samples_dir"), start, end)
+		infos, covered, used := averageInfos(samples, start, end)
+		if used == 0 {
+			er(fmt.Sprintf("no samples found for period %s in %s", period, viper.GetString("samples_dir")))
+		}
+		fmt.Fprintf(os.Stderr, "Averaged %d samples covering %s of %s\n", used, covered.Round(time.Hour), end.Sub(start).Round(time.Hour))
+
+		// spaces missing from a sample count as empty, so the average is incomplete as well
+		failures := []*instanceFailure{}
+		for _, s := range samples {
+			if !s.Time.Before(start) && s.Time.Before(end) {
+				failures = append(failures, s.Failures...)
+			}
+		}
+		printFailures(failures)
+
+		applyChargeOverrides(infos, loadChargeOverrides())
+		infos = cleanInfos(infos, showInvalid)
+		writeAccountingFiles(infos, out, model, dims, true, showOverrides, date, failures)
+	},
+}
+
+type accountingSample struct {
+	Time     time.Time
+	Records  []*infoRecord
+	Failures []*instanceFailure // EOS instances missing from the sample
+}
+
+// loadSamples reads the samples in dir needed to average [start, end), sorted
+// by time: the ones taken in the period and the last one taken before it.
+// Samples are selected by their YYYY-MM-DD.json file name, so only those are read.
+func loadSamples(dir string, start, end time.Time) []*accountingSample {
+	matches, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		er(err)
+	}
+
+	startDay := time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, time.Local)
+	files := []string{}
+	before := ""
+	for _, m := range matches {
+		day, err := time.ParseInLocation("2006-01-02", strings.TrimSuffix(filepath.Base(m), ".json"), time.Local)
+		if err != nil {
+			continue
+		}
+		switch {
+		case day.Before(startDay):
+			// names sort chronologically
+			if m > before {
+				before = m
+			}
+		case day.Before(end):
+			files = append(files, m)
+		}
+	}
+	if before != "" {
+		files = append(files, before)
+	}
+
+	samples := make([]*accountingSample, 0, len(files))
+	for _, f := range files {
+		s := &accountingSample{}
+		if err := loadJSON(f, s); err != nil {
+			er(fmt.Sprintf("error reading sample %s: %+v", f, err))
+		}
+		samples = append(samples, s)
+	}
+
+	sort.Slice(samples, func(i, j int) bool {
+		return samples[i].Time.Before(samples[j].Time)
+	})
+	return samples
+}
+
+// averageInfos computes the time-weighted average quota of every space over
+// [start, end). A sample is taken as valid until the next one, the last sample
+// taken before start gives the value at start. Spaces missing in a sample
+// count as zero for its interval. Owner and charge information comes from the
+// latest sample containing the space. It returns the averaged spaces, the
+// duration covered by samples and the number of samples used.
+func averageInfos(samples []*accountingSample, start, end time.Time) ([]*projectInfo, time.Duration, int) {
+	first := -1
+	for i, s := range samples {
+		if s.Time.After(start) {
+			break
+		}
+		first = i
+	}
+	if first == -1 {
+		first = 0
+	}
+
+	type accumulator struct {
+		info        *projectInfo
+		used, avail float64 // bytes x seconds
+	}
+	acc := map[string]*accumulator{}
+	order := []string{}
+
+	var covered time.Duration
+	var used int
+	for i := first; i < len(samples) && samples[i].Time.Before(end); i++ {
+		from := samples[i].Time
+		if from.Before(start) {
+			from = start
+		}
+		to := end
+		if i+1 < len(samples) && samples[i+1].Time.Before(end) {
+			to = samples[i+1].Time
+		}
+		w := to.Sub(from)
+		if w <= 0 {
+			continue
+		}
+		covered += w
+		used++
+
+		for _, info := range projectInfosFromRecords(samples[i].Records) {
+			k := info.FileInfo.Instance + info.FileInfo.File
+			a, ok := acc[k]
+			if !ok {
+				a = &accumulator{}
+				acc[k] = a
+				order = append(order, k)
+			}
+			a.info = info
+			a.used += float64(info.QuotaInfo.UsedBytes) * w.Seconds()
+			a.avail += float64(info.QuotaInfo.AvailableBytes) * w.Seconds()
+		}
+	}
+
+	infos := make([]*projectInfo, 0, len(acc))
+	if covered == 0 {
+		return infos, covered, used
+	}
+	for _, k := range order {
+		a := acc[k]
+		a.info.QuotaInfo = &eosclient.QuotaInfo{
+			UsedBytes:      int(a.used / covered.Seconds()),
+			AvailableBytes: int(a.avail / covered.Seconds()),
+		}
+		infos = append(infos, a.info)
+	}
+	return infos, covered, used
+}
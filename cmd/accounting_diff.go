@@ -0,0 +1,186 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/dustin/go-humanize"
+	"github.com/spf13/cobra"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+func init() {
+	accountingCmd.AddCommand(accountingDiffCmd)
+
+	accountingDiffCmd.Flags().Float64P("threshold", "t", 10, "report usage or quota changes above <n> percent")
+	accountingDiffCmd.Flags().String("min-delta", "1GB", "ignore usage or quota changes smaller than this size")
+}
+
+var accountingDiffCmd = &cobra.Command{
+	Use:   "diff <old> <new>\nExample: cernboxcop accounting diff 2020/10/01/accounting.txt 2020/11/01/accounting.txt",
+	Short: "Shows what changed between two accounting reports (accounting.txt or accounting-json-accreceiver.json)",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 2 {
+			exit(cmd)
+		}
+
+		threshold, _ := cmd.Flags().GetFloat64("threshold")
+		minDeltaStr, _ := cmd.Flags().GetString("min-delta")
+		minDelta, err := humanize.ParseBytes(minDeltaStr)
+		if err != nil {
+			er(err)
+		}
+
+		isJSON := filepath.Ext(args[0]) == ".json"
+		if isJSON != (filepath.Ext(args[1]) == ".json") {
+			er("both files must be of the same kind")
+		}
+
+		var before, after map[string]*diffEntry
+		if isJSON {
+			before, after = loadReceiverDiffEntries(args[0]), loadReceiverDiffEntries(args[1])
+		} else {
+			before, after = loadReportDiffEntries(args[0]), loadReportDiffEntries(args[1])
+		}
+
+		changes := diffEntries(before, after, threshold, int(minDelta))
+		cols := []string{"CHANGE", "KEY", "OLD", "NEW", "DELTA", "DELTA%"}
+		rows := make([][]string, 0, len(changes))
+		for _, c := range changes {
+			rows = append(rows, []string{c.kind, c.key, c.old, c.new, c.delta, c.percentage})
+		}
+		pretty(cols, rows)
+	},
+}
+
+// diffEntry is the comparable view of a row of any of the accounting files.
+// For accounting.txt the key is the space (instance and path), for the receiver
+// JSON it is the charge group and role.
+type diffEntry struct {
+	key         string
+	chargeGroup string
+	chargeRole  string
+	used, quota int
+}
+
+type diffChange struct {
+	kind, key, old, new, delta, percentage string
+}
+
+func loadReportDiffEntries(file string) map[string]*diffEntry {
+	fd, err := os.Open(file)
+	if err != nil {
+		er(err)
+	}
+	defer fd.Close()
+
+	rows, err := parseReport(fd)
+	if err != nil {
+		er(fmt.Sprintf("error parsing %s: %+v", file, err))
+	}
+
+	entries := make(map[string]*diffEntry, len(rows))
+	for _, row := range rows {
+		key := row["INSTANCE"] + ":" + row["PATH"]
+		entries[key] = &diffEntry{
+			key:         key,
+			chargeGroup: row["CHARGEGROUP"],
+			chargeRole:  row["CHARGEROLE"],
+			used:        atoi(row["USEDBYTES"]),
+			quota:       atoi(row["MAXBYTES"]),
+		}
+	}
+	return entries
+}
+
+func loadReceiverDiffEntries(file string) map[string]*diffEntry {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		er(err)
+	}
+
+	payload := []*accReceiverJSON{}
+	if err := json.Unmarshal(data, &payload); err != nil {
+		er(fmt.Sprintf("error parsing %s: %+v", file, err))
+	}
+
+	entries := make(map[string]*diffEntry, len(payload))
+	for _, p := range payload {
+		key := p.ChargeGroup + "/" + p.ChargeRole
+		entries[key] = &diffEntry{
+			key:         key,
+			chargeGroup: p.ChargeGroup,
+			chargeRole:  p.ChargeRole,
+			used:        p.DiskUsage,
+			quota:       p.DiskQuota,
+		}
+	}
+	return entries
+}
+
+// diffEntries compares two sets of entries. Usage and quota changes are only
+// reported if they are above both the percentage threshold and the minimum delta.
+func diffEntries(oldEntries, newEntries map[string]*diffEntry, threshold float64, minDelta int) []*diffChange {
+	changes := []*diffChange{}
+
+	sizeChange := func(kind, key string, from, to int) {
+		d := to - from
+		if d == 0 || abs(d) < minDelta {
+			return
+		}
+		if from != 0 && float64(abs(d))*100/float64(from) < threshold {
+			return
+		}
+		changes = append(changes, &diffChange{kind, key, humanQuota(from), humanQuota(to), humanDelta(d), percentDelta(from, to)})
+	}
+
+	for _, k := range sortedDiffKeys(oldEntries, newEntries) {
+		o, inOld := oldEntries[k]
+		n, inNew := newEntries[k]
+
+		if !inOld {
+			changes = append(changes, &diffChange{"added", k, "-", fmt.Sprintf("%s %s", n.chargeGroup, humanQuota(n.used)), humanDelta(n.used), "new"})
+			continue
+		}
+		if !inNew {
+			changes = append(changes, &diffChange{"removed", k, fmt.Sprintf("%s %s", o.chargeGroup, humanQuota(o.used)), "-", humanDelta(-o.used), "-100.00%"})
+			continue
+		}
+
+		if o.chargeGroup != n.chargeGroup {
+			changes = append(changes, &diffChange{"chargegroup", k, o.chargeGroup, n.chargeGroup, "-", "-"})
+		}
+		if o.chargeRole != n.chargeRole {
+			changes = append(changes, &diffChange{"chargerole", k, o.chargeRole, n.chargeRole, "-", "-"})
+		}
+		sizeChange("usage", k, o.used, n.used)
+		sizeChange("quota", k, o.quota, n.quota)
+	}
+	return changes
+}
+
+func sortedDiffKeys(oldEntries, newEntries map[string]*diffEntry) []string {
+	uniq := make(map[string]bool, len(oldEntries)+len(newEntries))
+	for k := range oldEntries {
+		uniq[k] = true
+	}
+	for k := range newEntries {
+		uniq[k] = true
+	}
+
+	keys := make([]string, 0, len(uniq))
+	for k := range uniq {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
@@ -0,0 +1,395 @@
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/cs3org/reva/pkg/eosclient"
+	"github.com/spf13/cobra"
+	"github.com/tj/go-spin"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func init() {
+	accountingCmd.AddCommand(accountingHistoryCmd)
+
+	accountingHistoryCmd.Flags().StringP("dir", "d", "", "local directory containing snapshots laid out as YYYY/MM/DD/accounting.txt")
+	accountingHistoryCmd.Flags().Bool("eos", false, "read snapshots from eos.accounting_dir, where report --push-eos stores them")
+	accountingHistoryCmd.Flags().String("from", "", "ignore snapshots before this date (YYYY-MM-DD)")
+	accountingHistoryCmd.Flags().String("to", "", "ignore snapshots after this date (YYYY-MM-DD)")
+	accountingHistoryCmd.Flags().String("by", "group", "aggregate growth by charge group (group) or by space (project)")
+	accountingHistoryCmd.Flags().StringP("filter", "f", "", "only show charge groups or paths containing this string")
+	accountingHistoryCmd.Flags().IntP("top", "t", 10, "number of top growers to show. 0 disables the top growers report")
+}
+
+var accountingHistoryCmd = &cobra.Command{
+	Use:   "history",
+	Short: "Shows storage growth over time from past accounting reports",
+	Run: func(cmd *cobra.Command, args []string) {
+		dir, _ := cmd.Flags().GetString("dir")
+		fromEOS, _ := cmd.Flags().GetBool("eos")
+		fromStr, _ := cmd.Flags().GetString("from")
+		toStr, _ := cmd.Flags().GetString("to")
+		by, _ := cmd.Flags().GetString("by")
+		filter, _ := cmd.Flags().GetString("filter")
+		top, _ := cmd.Flags().GetInt("top")
+
+		if (dir == "") == !fromEOS {
+			fmt.Fprintf(os.Stderr, "Error: provide either --dir or --eos\n")
+			exit(cmd)
+		}
+
+		if by != "group" && by != "project" {
+			fmt.Fprintf(os.Stderr, "Error: --by must be group or project\n")
+			exit(cmd)
+		}
+
+		from, to := parseDateRange(fromStr, toStr)
+
+		var snapshots []*accountingSnapshot
+		if fromEOS {
+			snapshots = loadEOSSnapshots(from, to)
+		} else {
+			snapshots = loadLocalSnapshots(dir, from, to)
+		}
+
+		if len(snapshots) == 0 {
+			er("no snapshots found")
+		}
+
+		monthly := monthlySnapshots(snapshots)
+		keyFn := snapshotGroupKey
+		if by == "project" {
+			keyFn = snapshotProjectKey
+		}
+
+		cols := []string{"MONTH", "KEY", "USEDBYTES", "USEDBYTESH", "DELTA", "DELTAH", "DELTA%"}
+		rows := [][]string{}
+		previous := map[string]int{}
+		for i, s := range monthly {
+			usage := s.usageBy(keyFn)
+			keys := make([]string, 0, len(usage))
+			for k := range usage {
+				if filter == "" || strings.Contains(k, filter) {
+					keys = append(keys, k)
+				}
+			}
+			sort.Strings(keys)
+
+			for _, k := range keys {
+				used := usage[k]
+				delta, deltaH, deltaPct := "-", "-", "-"
+				if i > 0 {
+					d := used - previous[k]
+					delta = fmt.Sprintf("%d", d)
+					deltaH = humanDelta(d)
+					deltaPct = percentDelta(previous[k], used)
+				}
+				rows = append(rows, []string{s.date.Format("2006-01"), k, fmt.Sprintf("%d", used), humanQuota(used), delta, deltaH, deltaPct})
+			}
+			previous = usage
+		}
+		pretty(cols, rows)
+
+		if top > 0 && len(snapshots) > 1 {
+			first, last := snapshots[0], snapshots[len(snapshots)-1]
+			fmt.Printf("\nTop %d growers between %s and %s\n\n", top, first.date.Format("2006-01-02"), last.date.Format("2006-01-02"))
+			prettyGrowers(topGrowers(first, last, keyFn, filter, top))
+		}
+	},
+}
+
+type accountingSnapshot struct {
+	date time.Time
+	rows []map[string]string
+}
+
+// usageBy returns the used bytes of the snapshot aggregated with the given key function.
+// Quotas are per account and instance, so rows sharing the same quota node are only counted once.
+func (s *accountingSnapshot) usageBy(keyFn func(map[string]string) string) map[string]int {
+	usage := map[string]int{}
+	seen := map[string]bool{}
+	for _, row := range s.rows {
+		node := row["ACC"] + row["INSTANCE"]
+		if row["ACC"] == "" {
+			node = row["INSTANCE"] + row["PATH"]
+		}
+		if seen[node] {
+			continue
+		}
+		seen[node] = true
+		usage[keyFn(row)] += atoi(row["USEDBYTES"])
+	}
+	return usage
+}
+
+var snapshotGroupKey = func(row map[string]string) string {
+	if row["CHARGEGROUP"] == "" {
+		return "Unknown"
+	}
+	return row["CHARGEGROUP"]
+}
+
+var snapshotProjectKey = func(row map[string]string) string {
+	return row["PATH"]
+}
+
+type grower struct {
+	key        string
+	from, to   int
+	delta      int
+	percentage string
+}
+
+func topGrowers(first, last *accountingSnapshot, keyFn func(map[string]string) string, filter string, n int) []*grower {
+	before := first.usageBy(keyFn)
+	after := last.usageBy(keyFn)
+
+	growers := []*grower{}
+	for k, used := range after {
+		if filter != "" && !strings.Contains(k, filter) {
+			continue
+		}
+		g := &grower{key: k, from: before[k], to: used, delta: used - before[k], percentage: percentDelta(before[k], used)}
+		growers = append(growers, g)
+	}
+
+	sort.Slice(growers, func(i, j int) bool {
+		if growers[i].delta == growers[j].delta {
+			return growers[i].key < growers[j].key
+		}
+		return growers[i].delta > growers[j].delta
+	})
+
+	if len(growers) > n {
+		growers = growers[:n]
+	}
+	return growers
+}
+
+func prettyGrowers(growers []*grower) {
+	cols := []string{"KEY", "FROMH", "TOH", "DELTA", "DELTAH", "DELTA%"}
+	rows := make([][]string, 0, len(growers))
+	for _, g := range growers {
+		rows = append(rows, []string{g.key, humanQuota(g.from), humanQuota(g.to), fmt.Sprintf("%d", g.delta), humanDelta(g.delta), g.percentage})
+	}
+	pretty(cols, rows)
+}
+
+// monthlySnapshots keeps the last snapshot of every month. Snapshots must be sorted by date.
+func monthlySnapshots(snapshots []*accountingSnapshot) []*accountingSnapshot {
+	monthly := []*accountingSnapshot{}
+	for _, s := range snapshots {
+		n := len(monthly)
+		if n > 0 && monthly[n-1].date.Format("2006-01") == s.date.Format("2006-01") {
+			monthly[n-1] = s
+			continue
+		}
+		monthly = append(monthly, s)
+	}
+	return monthly
+}
+
+func loadLocalSnapshots(dir string, from, to time.Time) []*accountingSnapshot {
+	matches, err := filepath.Glob(filepath.Join(dir, "*", "*", "*", "accounting.txt"))
+	if err != nil {
+		er(err)
+	}
+
+	snapshots := []*accountingSnapshot{}
+	s := spin.New()
+	for _, m := range matches {
+		rel, _ := filepath.Rel(dir, filepath.Dir(m))
+		date, err := time.ParseInLocation("2006/01/02", filepath.ToSlash(rel), time.Local)
+		if err != nil || !inDateRange(date, from, to) {
+			continue
+		}
+
+		fmt.Fprintf(os.Stderr, "\r %s Loading snapshot %s", s.Next(), rel)
+		fd, err := os.Open(m)
+		if err != nil {
+			er(err)
+		}
+		rows, err := parseReport(fd)
+		fd.Close()
+		if err != nil {
+			er(fmt.Sprintf("error parsing %s: %+v", m, err))
+		}
+		snapshots = append(snapshots, &accountingSnapshot{date: date, rows: rows})
+	}
+	fmt.Fprintln(os.Stderr)
+
+	sortSnapshots(snapshots)
+	return snapshots
+}
+
+func loadEOSSnapshots(from, to time.Time) []*accountingSnapshot {
+	ctx, cancel := context.WithTimeout(getCtx(), time.Minute*10)
+	defer cancel()
+	t := getTopology()
+	client := getEOS(t.resolve(t.AccountingMGM))
+	accountingEOSDir := t.AccountingDir
+
+	list := func(dir string) []string {
+		mds, err := client.List(ctx, "root", dir)
+		if err != nil {
+			er(err)
+		}
+		entries := make([]string, 0, len(mds))
+		for _, md := range mds {
+			if md.IsDir {
+				entries = append(entries, md.File)
+			}
+		}
+		return entries
+	}
+
+	snapshots := []*accountingSnapshot{}
+	s := spin.New()
+	for _, year := range list(accountingEOSDir) {
+		for _, month := range list(year) {
+			for _, day := range list(month) {
+				rel := strings.TrimPrefix(day, accountingEOSDir)
+				date, err := time.ParseInLocation("2006/01/02", strings.Trim(rel, "/"), time.Local)
+				if err != nil || !inDateRange(date, from, to) {
+					continue
+				}
+
+				fmt.Fprintf(os.Stderr, "\r %s Loading snapshot %s", s.Next(), rel)
+				rc, err := client.Read(ctx, "root", path.Join(day, "accounting.txt"))
+				if err != nil {
+					log.Error().Msgf("error reading snapshot from EOS: dir:%s err:%+v", day, err)
+					continue
+				}
+				rows, err := parseReport(rc)
+				rc.Close()
+				if err != nil {
+					er(fmt.Sprintf("error parsing %s: %+v", day, err))
+				}
+				snapshots = append(snapshots, &accountingSnapshot{date: date, rows: rows})
+			}
+		}
+	}
+	fmt.Fprintln(os.Stderr)
+
+	sortSnapshots(snapshots)
+	return snapshots
+}
+
+func sortSnapshots(snapshots []*accountingSnapshot) {
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].date.Before(snapshots[j].date)
+	})
+}
+
+// parseReport reads back a table written by save, returning one map per row keyed by column name.
+func parseReport(r io.Reader) ([]map[string]string, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+
+	var cols []string
+	rows := []map[string]string{}
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		fields := strings.Split(line, "\t")
+		for i := range fields {
+			fields[i] = strings.TrimSpace(fields[i])
+		}
+
+		if cols == nil {
+			cols = fields
+			continue
+		}
+
+		row := make(map[string]string, len(cols))
+		for i, c := range cols {
+			if i < len(fields) {
+				row[c] = fields[i]
+			}
+		}
+		rows = append(rows, row)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if cols == nil {
+		return nil, fmt.Errorf("empty report")
+	}
+	return rows, nil
+}
+
+// reportInfos rebuilds the spaces of the rows of an accounting.txt, with the
+// columns needed to aggregate and charge them.
+func reportInfos(rows []map[string]string) []*projectInfo {
+	infos := make([]*projectInfo, 0, len(rows))
+	for _, row := range rows {
+		owner := &userInfo{UID: row["UID"], GID: row["GID"], Account: row["OWNER"], Name: row["NAME"], Department: row["DEPT"], Group: row["GROUP"], Section: row["SECTION"]}
+		infos = append(infos, &projectInfo{
+			FileInfo:   &eosclient.FileInfo{Instance: row["INSTANCE"], File: row["PATH"]},
+			userInfo:   &userInfo{Account: row["ACC"], AccountType: strings.TrimSuffix(row["ACCTYPE"], "-Account"), AccountOwner: owner},
+			QuotaInfo:  &eosclient.QuotaInfo{UsedBytes: atoi(row["USEDBYTES"]), AvailableBytes: atoi(row["MAXBYTES"])},
+			chargeInfo: chargeInfo{Type: row["CHARGETYPE"], ChargeGroup: row["CHARGEGROUP"], ChargeRole: row["CHARGEROLE"]},
+		})
+	}
+	return infos
+}
+
+func parseDateRange(from, to string) (time.Time, time.Time) {
+	var f, t time.Time
+	var err error
+	if from != "" {
+		if f, err = time.ParseInLocation("2006-01-02", from, time.Local); err != nil {
+			er(err)
+		}
+	}
+	if to != "" {
+		if t, err = time.ParseInLocation("2006-01-02", to, time.Local); err != nil {
+			er(err)
+		}
+	}
+	return f, t
+}
+
+func inDateRange(d, from, to time.Time) bool {
+	if !from.IsZero() && d.Before(from) {
+		return false
+	}
+	if !to.IsZero() && d.After(to) {
+		return false
+	}
+	return true
+}
+
+func atoi(s string) int {
+	v, _ := strconv.Atoi(s)
+	return v
+}
+
+func humanDelta(delta int) string {
+	if delta < 0 {
+		return "-" + humanQuota(-delta)
+	}
+	return "+" + humanQuota(delta)
+}
+
+func percentDelta(before, after int) string {
+	if before == 0 {
+		if after == 0 {
+			return "0.00%"
+		}
+		return "new"
+	}
+	return fmt.Sprintf("%+.2f%%", float64(after-before)*100/float64(before))
+}
@@ -0,0 +1,201 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+func init() {
+	viper.SetDefault("invalid_contact", "cernbox-admins@cern.ch")
+
+	accountingCmd.AddCommand(accountingInvalidCmd)
+
+	accountingInvalidCmd.Flags().IntP("concurrency", "c", 200, "use up to <n> concurrent connections to retrive information from external services (LDAP)")
+	accountingInvalidCmd.Flags().IntP("limit", "l", -1, "checks <n> first spaces of every namespace. -1 means all.")
+	accountingInvalidCmd.Flags().Bool("user-also", false, "checks user home directories also")
+	accountingInvalidCmd.Flags().StringSliceP("namespace", "n", nil, "namespaces of the eos topology to check, by default the ones with report = true")
+	accountingInvalidCmd.Flags().Bool("resume", false, "continues the last failed run from its last completed stage (listing, users, quotas, charging)")
+	accountingInvalidCmd.Flags().StringP("dir", "d", "", "local directory with past snapshots (YYYY/MM/DD/accounting.txt) to compute how long entries have been invalid")
+	accountingInvalidCmd.Flags().Bool("eos", false, "read past snapshots from eos.accounting_dir")
+	accountingInvalidCmd.Flags().String("from", time.Now().Local().AddDate(-1, 0, 0).Format("2006-01-02"), "ignore snapshots before this date (YYYY-MM-DD)")
+	accountingInvalidCmd.Flags().StringP("out", "o", "", "also writes the report into this file")
+}
+
+var accountingInvalidCmd = &cobra.Command{
+	Use:   "invalid",
+	Short: "Reports the spaces that cannot be charged, why, who to contact and since when",
+	Run: func(cmd *cobra.Command, args []string) {
+		head, _ := cmd.Flags().GetInt("limit")
+		conc, _ := cmd.Flags().GetInt("concurrency")
+		userAlso, _ := cmd.Flags().GetBool("user-also")
+		names, _ := cmd.Flags().GetStringSlice("namespace")
+		resume, _ := cmd.Flags().GetBool("resume")
+		dir, _ := cmd.Flags().GetString("dir")
+		fromEOS, _ := cmd.Flags().GetBool("eos")
+		fromStr, _ := cmd.Flags().GetString("from")
+		out, _ := cmd.Flags().GetString("out")
+
+		if dir != "" && fromEOS {
+			er("provide either --dir or --eos")
+		}
+		namespaces, err := getTopology().reportNamespaces(names, userAlso)
+		if err != nil {
+			er(err)
+		}
+
+		cp := openCheckpoint("invalid", resume, head, namespaces, true)
+		infos, _ := collectInfos(cp, head, conc, namespaces, true, true)
+
+		var snapshots []*accountingSnapshot
+		from, _ := parseDateRange(fromStr, "")
+		if fromEOS {
+			snapshots = loadEOSSnapshots(from, time.Time{})
+		} else if dir != "" {
+			snapshots = loadLocalSnapshots(dir, from, time.Time{})
+		}
+
+		validity := newSnapshotValidity(snapshots)
+		pool := newLDAPPool()
+		defer pool.close()
+
+		now := time.Now().Local()
+		cols := []string{"INSTANCE", "PATH", "ACC", "REASON", "DETAIL", "CONTACT", "INVALIDSINCE", "DAYS"}
+		rows := [][]string{}
+		for _, p := range invalidInfos(infos) {
+			reason, detail := diagnoseInvalid(pool, p)
+			since, days := "-", "-"
+			if len(validity) > 0 {
+				if t := invalidSince(p, validity); !t.IsZero() {
+					since = t.Format("2006-01-02")
+					days = fmt.Sprintf("%d", int(now.Sub(t).Hours()/24))
+				}
+			}
+			rows = append(rows, []string{p.FileInfo.Instance, p.FileInfo.File, p.userInfo.Account, reason, detail, invalidContact(p), since, days})
+		}
+
+		pretty(cols, rows)
+		if out != "" {
+			save(cols, rows, out)
+		}
+		cp.done()
+	},
+}
+
+// Reasons why a space cannot be charged.
+const (
+	invalidUIDUnresolvable = "uid-unresolvable"
+	invalidLDAPMissing     = "ldap-missing"
+	invalidLDAPError       = "ldap-error"
+	invalidOwnerDeparted   = "owner-departed"
+	invalidNoCharge        = "receiver-empty"
+)
+
+// invalidInfos returns the spaces without a valid charge group, sorted by path.
+func invalidInfos(infos []*projectInfo) []*projectInfo {
+	invalid := []*projectInfo{}
+	for _, p := range infos {
+		if p.chargeInfo.ChargeGroup == "" || p.chargeInfo.ChargeGroup == "Unknown" {
+			invalid = append(invalid, p)
+		}
+	}
+	sort.Slice(invalid, func(i, j int) bool {
+		return invalid[i].FileInfo.File < invalid[j].FileInfo.File
+	})
+	return invalid
+}
+
+// diagnoseInvalid explains why p has no charge group, looking at the first
+// step of the pipeline that could not be completed. The account is looked up
+// again, so a lookup that failed while collecting is not reported as a
+// missing account.
+func diagnoseInvalid(pool *ldapPool, p *projectInfo) (string, string) {
+	ui := p.userInfo
+	if ui.Account == "" {
+		username, err := getUsername(p.FileInfo.UID)
+		if err != nil {
+			return invalidUIDUnresolvable, fmt.Sprintf("uid %d of the space owner has no username", p.FileInfo.UID)
+		}
+		found, err := getAccountInfo(pool, username)
+		switch {
+		case err != nil:
+			return invalidLDAPError, fmt.Sprintf("LDAP lookup of account %s (uid %d) failed: %v", username, p.FileInfo.UID, err)
+		case found.Account != "":
+			return invalidLDAPError, fmt.Sprintf("LDAP lookup of account %s (uid %d) failed while collecting, it succeeds now", username, p.FileInfo.UID)
+		}
+		return invalidLDAPMissing, fmt.Sprintf("account %s (uid %d) not found in LDAP, it may have been deleted", username, p.FileInfo.UID)
+	}
+
+	if (ui.AccountType == "Service" || ui.AccountType == "Secondary") && (ui.AccountOwner == nil || ui.AccountOwner.Account == "") {
+		if _, err := getAccountInfo(pool, ui.Account); err != nil {
+			return invalidLDAPError, fmt.Sprintf("LDAP lookup of the owner of %s failed: %v", ui.Account, err)
+		}
+		owner := extractCN(ui.AccountOwnerDN)
+		if owner == "" {
+			return invalidOwnerDeparted, fmt.Sprintf("%s account %s has no owner", strings.ToLower(ui.AccountType), ui.Account)
+		}
+		return invalidOwnerDeparted, fmt.Sprintf("owner %s of %s account %s not found in LDAP", owner, strings.ToLower(ui.AccountType), ui.Account)
+	}
+
+	return invalidNoCharge, fmt.Sprintf("account receiver returned no charge group for %s", ui.Account)
+}
+
+// invalidContact returns who can fix the charging of p: the owner of the
+// account, the account itself, the admins e-group of a project space, or
+// invalid_contact.
+func invalidContact(p *projectInfo) string {
+	ui := p.userInfo
+	if ui.AccountOwner != nil && ui.AccountOwner.Mail != "" {
+		return ui.AccountOwner.Mail
+	}
+	if ui.Mail != "" {
+		return ui.Mail
+	}
+	if ns := getTopology().namespaceOfPath(p.FileInfo.File); ns != nil && ns.Name == "project" {
+		return fmt.Sprintf("cernbox-project-%s-admins@%s", path.Base(p.FileInfo.File), viper.GetString("mail_domain"))
+	}
+	return viper.GetString("invalid_contact")
+}
+
+// snapshotValidity tells for every space of a snapshot whether it could be
+// charged, keyed by INSTANCE and PATH.
+type snapshotValidity struct {
+	date  time.Time
+	valid map[string]bool
+}
+
+func newSnapshotValidity(snapshots []*accountingSnapshot) []*snapshotValidity {
+	validity := make([]*snapshotValidity, 0, len(snapshots))
+	for _, s := range snapshots {
+		v := &snapshotValidity{date: s.date, valid: make(map[string]bool, len(s.rows))}
+		for _, row := range s.rows {
+			v.valid[row["INSTANCE"]+"\x00"+row["PATH"]] = row["CHARGEGROUP"] != "" && row["CHARGEGROUP"] != "Unknown"
+		}
+		validity = append(validity, v)
+	}
+	return validity
+}
+
+// invalidSince returns the first day of the latest run of snapshots in which
+// p was invalid. Reports drop invalid rows unless run with --show-invalid, so
+// a space missing from a snapshot taken after its creation counts as invalid.
+// It returns the zero time if p was valid in the last snapshot.
+func invalidSince(p *projectInfo, validity []*snapshotValidity) time.Time {
+	k := p.FileInfo.Instance + "\x00" + p.FileInfo.File
+	var since time.Time
+	for i := len(validity) - 1; i >= 0; i-- {
+		v := validity[i]
+		if !p.created.IsZero() && v.date.AddDate(0, 0, 1).Before(p.created) {
+			break
+		}
+		if v.valid[k] {
+			break
+		}
+		since = v.date
+	}
+	return since
+}
@@ -0,0 +1,97 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+	"net/http"
+	"os"
+)
+
+func init() {
+	accountingCmd.AddCommand(accountingReceiverCmd)
+	accountingReceiverCmd.AddCommand(accountingReceiverPushCmd)
+	accountingReceiverCmd.AddCommand(accountingReceiverValidateCmd)
+	accountingReceiverCmd.AddCommand(accountingReceiverServeCmd)
+
+	accountingReceiverPushCmd.Flags().Bool("dev", false, "push to receiver_dev_url instead of receiver_url")
+	accountingReceiverPushCmd.Flags().String("url", "", "push to this endpoint instead of the configured ones")
+	accountingReceiverPushCmd.Flags().Bool("force", false, "push even if the same payload was already pushed for its date")
+
+	accountingReceiverServeCmd.Flags().String("listen", ":8090", "address to listen on")
+	accountingReceiverServeCmd.Flags().String("api-key", "", "API-Key required to push, empty accepts any")
+	accountingReceiverServeCmd.Flags().String("charges", "", "JSON file mapping accounts to their charge information, as returned by the receiver")
+}
+
+var accountingReceiverCmd = &cobra.Command{
+	Use:   "receiver",
+	Short: "Accounting receiver client and local stand-in",
+}
+
+var accountingReceiverPushCmd = &cobra.Command{
+	Use:   "push <accounting-json-accreceiver.json>",
+	Short: "Validates and pushes receiver records to the accounting receiver",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 1 {
+			exit(cmd)
+		}
+
+		dev, _ := cmd.Flags().GetBool("dev")
+		url, _ := cmd.Flags().GetString("url")
+		force, _ := cmd.Flags().GetBool("force")
+		if url == "" {
+			url = getReceiverURL(dev)
+		}
+
+		c := newReceiverClient(url)
+		pushed, err := c.pushFile(args[0], force)
+		if err != nil {
+			er(err)
+		}
+		if pushed {
+			fmt.Println("Data pushed to " + url)
+		} else {
+			fmt.Println("Data already pushed to " + url + ", use --force to push it again")
+		}
+	},
+}
+
+var accountingReceiverValidateCmd = &cobra.Command{
+	Use:   "validate <accounting-json-accreceiver.json>",
+	Short: "Validates receiver records without pushing them",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 1 {
+			exit(cmd)
+		}
+
+		records, err := loadReceiverRecords(args[0])
+		if err != nil {
+			er(err)
+		}
+		if err := validateReceiverRecords(records); err != nil {
+			er(err)
+		}
+		fmt.Printf("%d records are valid\n", len(records))
+	},
+}
+
+var accountingReceiverServeCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "Runs a local stand-in of the accounting receiver, set receiver_url and receiver_charging_url to use it",
+	Run: func(cmd *cobra.Command, args []string) {
+		listen, _ := cmd.Flags().GetString("listen")
+		apiKey, _ := cmd.Flags().GetString("api-key")
+		chargesFile, _ := cmd.Flags().GetString("charges")
+
+		charges := map[string]*chargeInfo{}
+		if chargesFile != "" {
+			if err := loadJSON(chargesFile, &charges); err != nil {
+				er(err)
+			}
+		}
+
+		fmt.Fprintf(os.Stderr, "Serving accounting receiver stand-in on %s\n", listen)
+		if err := http.ListenAndServe(listen, newReceiverStandIn(apiKey, charges)); err != nil {
+			er(err)
+		}
+	},
+}
@@ -0,0 +1,221 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/cs3org/reva/pkg/eosclient"
+	"sort"
+	"strings"
+	"time"
+)
+
+// aggregateDimension is an attribute of a space used to group accounting rows.
+type aggregateDimension struct {
+	name  string // name used in --group-by
+	col   string // column in the generated report
+	value func(*projectInfo) string
+}
+
+var (
+	dimChargeGroup = &aggregateDimension{"chargegroup", "CHARGEGROUP", func(p *projectInfo) string { return p.chargeInfo.ChargeGroup }}
+	dimChargeRole  = &aggregateDimension{"chargerole", "CHARGEROLE", func(p *projectInfo) string { return p.chargeInfo.ChargeRole }}
+	dimSimpleRole  = &aggregateDimension{"simplerole", "SIMPLEROLE", simplifiedRoleOf}
+	dimDepartment  = &aggregateDimension{"department", "DEPT", func(p *projectInfo) string { return p.userInfo.AccountOwner.Department }}
+	dimInstance    = &aggregateDimension{"instance", "INSTANCE", func(p *projectInfo) string { return p.FileInfo.Instance }}
+	dimAccountType = &aggregateDimension{"accounttype", "ACCTYPE", func(p *projectInfo) string { return p.userInfo.accountTypeHuman() }}
+)
+
+var aggregateDimensions = []*aggregateDimension{dimChargeGroup, dimChargeRole, dimSimpleRole, dimDepartment, dimInstance, dimAccountType}
+
+// getAggregateDimensions resolves dimension names as given in --group-by.
+func getAggregateDimensions(names []string) ([]*aggregateDimension, error) {
+	dims := make([]*aggregateDimension, 0, len(names))
+	for _, n := range names {
+		var found *aggregateDimension
+		for _, d := range aggregateDimensions {
+			if d.name == strings.ToLower(strings.TrimSpace(n)) {
+				found = d
+			}
+		}
+		if found == nil {
+			valid := make([]string, 0, len(aggregateDimensions))
+			for _, d := range aggregateDimensions {
+				valid = append(valid, d.name)
+			}
+			return nil, fmt.Errorf("unknown dimension %q, valid ones are: %s", n, strings.Join(valid, ", "))
+		}
+		dims = append(dims, found)
+	}
+	return dims, nil
+}
+
+// simplifiedRoleOf returns the simple role of the namespace of the space.
+func simplifiedRoleOf(p *projectInfo) string {
+	if p.chargeInfo.ChargeRole == "" || p.chargeInfo.ChargeRole == "Unknown" {
+		return "Unknown"
+	}
+	if ns := getTopology().namespaceOfPath(p.FileInfo.File); ns != nil {
+		return ns.simpleRole()
+	}
+	return simplifiedRole(p.chargeInfo.ChargeRole)
+}
+
+func simplifiedRole(role string) string {
+	if strings.HasPrefix(role, "CERNBox Project") {
+		return "CERNBox Project Spaces"
+	} else if strings.Contains(role, "Account") {
+		return "CERNBox Home Directories"
+	}
+	return "Unknown"
+}
+
+type aggregateRow struct {
+	keys      []string // one value per dimension
+	quota     eosclient.QuotaInfo
+	spaces    int     // number of quota nodes in the row
+	cost      float64 // sum of the cost of every quota node
+	overrides int     // quota nodes charged by a charge override
+}
+
+// quotaNodeKey identifies the EOS quota node a space is accounted against.
+// Quotas are set per account and instance, so all the spaces of an account in
+// the same instance share the same node. Spaces without an account have no
+// quota node and are identified by their path.
+func quotaNodeKey(p *projectInfo) string {
+	if p.userInfo.Account == "" {
+		return "path:" + p.FileInfo.Instance + p.FileInfo.File
+	}
+	return "account:" + p.userInfo.Account + "@" + p.FileInfo.Instance
+}
+
+// quotaNode is a quota node and the space it is accounted under.
+type quotaNode struct {
+	space  *projectInfo // space with the lowest path
+	spaces int          // number of spaces sharing the node
+}
+
+// quotaNodes groups infos by quota node. When several spaces share a node,
+// the one with the lowest path is kept so results do not depend on the input
+// order. The result is sorted by path.
+var quotaNodes = func(infos []*projectInfo) []*quotaNode {
+	nodes := map[string]*quotaNode{}
+	for _, info := range infos {
+		k := quotaNodeKey(info)
+		n, ok := nodes[k]
+		if !ok {
+			n = &quotaNode{space: info}
+			nodes[k] = n
+		} else if info.FileInfo.File < n.space.FileInfo.File {
+			n.space = info
+		}
+		n.spaces++
+	}
+
+	sorted := make([]*quotaNode, 0, len(nodes))
+	for _, n := range nodes {
+		sorted = append(sorted, n)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		a, b := sorted[i].space.FileInfo, sorted[j].space.FileInfo
+		if a.File == b.File {
+			return a.Instance < b.Instance
+		}
+		return a.File < b.File
+	})
+	return sorted
+}
+
+// uniqueQuotaNodes returns the space each quota node is accounted under,
+// sorted by path.
+var uniqueQuotaNodes = func(infos []*projectInfo) []*projectInfo {
+	nodes := quotaNodes(infos)
+	uniq := make([]*projectInfo, 0, len(nodes))
+	for _, n := range nodes {
+		uniq = append(uniq, n.space)
+	}
+	return uniq
+}
+
+// aggregate sums the quotas of the unique quota nodes grouped by the given
+// dimensions. Rows are sorted by their keys. The cost is computed per quota
+// node with model, if not nil, and then summed.
+var aggregate = func(infos []*projectInfo, model *costModel, dims ...*aggregateDimension) []*aggregateRow {
+	rows := map[string]*aggregateRow{}
+	for _, info := range uniqueQuotaNodes(infos) {
+		keys := make([]string, 0, len(dims))
+		for _, d := range dims {
+			keys = append(keys, d.value(info))
+		}
+
+		k := strings.Join(keys, "\x00")
+		row, ok := rows[k]
+		if !ok {
+			row = &aggregateRow{keys: keys}
+			rows[k] = row
+		}
+		row.quota.AvailableBytes += info.QuotaInfo.AvailableBytes
+		row.quota.UsedBytes += info.QuotaInfo.UsedBytes
+		row.quota.AvailableInodes += info.QuotaInfo.AvailableInodes
+		row.quota.UsedInodes += info.QuotaInfo.UsedInodes
+		row.spaces++
+		if info.chargeInfo.Override != "" {
+			row.overrides++
+		}
+		if model != nil {
+			row.cost += model.cost(newCostInput(info))
+		}
+	}
+
+	sorted := make([]*aggregateRow, 0, len(rows))
+	for _, row := range rows {
+		sorted = append(sorted, row)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		a, b := sorted[i].keys, sorted[j].keys
+		for n := range a {
+			if a[n] != b[n] {
+				return a[n] < b[n]
+			}
+		}
+		return false
+	})
+	return sorted
+}
+
+// writeAggregate saves the aggregation of infos by dims into file. The number
+// of quota nodes charged by an override is added if showOverrides is set.
+var writeAggregate = func(infos []*projectInfo, file string, model *costModel, showOverrides bool, dims ...*aggregateDimension) {
+	cols := []string{
+		"MAXBYTES",
+		"USEDBYTES",
+		"MAXBYTESH",
+		"USEDBYTESH",
+		"CREATED",
+	}
+	for _, d := range dims {
+		cols = append(cols, d.col)
+	}
+	cols = append(cols, "COSTH")
+	if showOverrides {
+		cols = append(cols, "OVERRIDES")
+	}
+
+	created := time.Now().Local().Format("2006-01-02")
+	rows := [][]string{}
+	for _, agg := range aggregate(infos, model, dims...) {
+		row := []string{
+			fmt.Sprintf("%d", agg.quota.AvailableBytes),
+			fmt.Sprintf("%d", agg.quota.UsedBytes),
+			humanQuota(agg.quota.AvailableBytes),
+			humanQuota(agg.quota.UsedBytes),
+			created,
+		}
+		row = append(row, agg.keys...)
+		row = append(row, model.format(agg.cost))
+		if showOverrides {
+			row = append(row, fmt.Sprintf("%d", agg.overrides))
+		}
+		rows = append(rows, row)
+	}
+
+	save(cols, rows, file)
+}
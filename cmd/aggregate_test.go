@@ -0,0 +1,247 @@
+package cmd
+
+import (
+	"github.com/cs3org/reva/pkg/eosclient"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testSpace builds a space of account in instance with the quota of its node.
+func testSpace(account, instance, file string, used, max int, group, role string) *projectInfo {
+	owner := &userInfo{Account: account, Department: "IT"}
+	return &projectInfo{
+		FileInfo:   &eosclient.FileInfo{File: file, Instance: instance},
+		userInfo:   &userInfo{Account: account, AccountType: "Primary", AccountOwner: owner},
+		QuotaInfo:  &eosclient.QuotaInfo{UsedBytes: used, AvailableBytes: max},
+		chargeInfo: chargeInfo{ChargeGroup: group, ChargeRole: role},
+	}
+}
+
+func TestQuotaNodeKey(t *testing.T) {
+	tests := []struct {
+		name  string
+		space *projectInfo
+		want  string
+	}{
+		{"account", testSpace("jdoe", "eoshome-j", "/eos/user/j/jdoe", 1, 2, "IT", "Primary-Account"), "account:jdoe@eoshome-j"},
+		{"no account", testSpace("", "eosproject-c", "/eos/project/c/cernbox", 1, 2, "IT", ""), "path:eosproject-c/eos/project/c/cernbox"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := quotaNodeKey(tt.space); got != tt.want {
+				t.Errorf("quotaNodeKey() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUniqueQuotaNodes(t *testing.T) {
+	tests := []struct {
+		name   string
+		spaces []*projectInfo
+		want   []string // paths kept, in order
+	}{
+		{
+			name: "spaces of one node keep the lowest path",
+			spaces: []*projectInfo{
+				testSpace("svc", "eosproject-c", "/eos/project/c/zeta", 10, 100, "IT", "r"),
+				testSpace("svc", "eosproject-c", "/eos/project/c/alpha", 10, 100, "IT", "r"),
+				testSpace("svc", "eosproject-c", "/eos/project/c/mid", 10, 100, "IT", "r"),
+			},
+			want: []string{"/eos/project/c/alpha"},
+		},
+		{
+			name: "same account in another instance is another node",
+			spaces: []*projectInfo{
+				testSpace("svc", "eosproject-c", "/eos/project/c/cernbox", 10, 100, "IT", "r"),
+				testSpace("svc", "eosproject-d", "/eos/project/d/data", 20, 100, "IT", "r"),
+			},
+			want: []string{"/eos/project/c/cernbox", "/eos/project/d/data"},
+		},
+		{
+			name: "spaces without account are keyed by path",
+			spaces: []*projectInfo{
+				testSpace("", "eosproject-c", "/eos/project/c/b", 10, 100, "", ""),
+				testSpace("", "eosproject-c", "/eos/project/c/a", 10, 100, "", ""),
+				testSpace("", "eosproject-c", "/eos/project/c/a", 10, 100, "", ""),
+			},
+			want: []string{"/eos/project/c/a", "/eos/project/c/b"},
+		},
+		{
+			name: "different nodes with the same usage are kept",
+			spaces: []*projectInfo{
+				testSpace("alice", "eoshome-a", "/eos/user/a/alice", 10, 100, "IT", "r"),
+				testSpace("anna", "eoshome-a", "/eos/user/a/anna", 10, 100, "IT", "r"),
+			},
+			want: []string{"/eos/user/a/alice", "/eos/user/a/anna"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := []string{}
+			for _, s := range uniqueQuotaNodes(tt.spaces) {
+				got = append(got, s.FileInfo.File)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("uniqueQuotaNodes() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAggregate(t *testing.T) {
+	spaces := []*projectInfo{
+		// one quota node shared by two project spaces
+		testSpace("svc1", "eosproject-c", "/eos/project/c/cernbox", 10, 100, "IT", "CERNBox Project Spaces"),
+		testSpace("svc1", "eosproject-c", "/eos/project/c/cernbox-dev", 10, 100, "IT", "CERNBox Project Spaces"),
+		testSpace("svc2", "eosproject-d", "/eos/project/d/data", 20, 200, "IT", "CERNBox Project Spaces"),
+		testSpace("jdoe", "eoshome-j", "/eos/user/j/jdoe", 5, 50, "IT", "Primary-Account"),
+		testSpace("asmith", "eoshome-a", "/eos/user/a/asmith", 7, 70, "PH", "Primary-Account"),
+	}
+	spaces[4].userInfo.AccountOwner.Department = "EP"
+	spaces[4].userInfo.AccountType = "Secondary"
+
+	type row struct {
+		keys       string
+		used, max  int
+		spaceCount int
+	}
+	tests := []struct {
+		name string
+		dims []*aggregateDimension
+		want []row
+	}{
+		{"no dimension", nil, []row{{"", 42, 420, 4}}},
+		{"chargegroup", []*aggregateDimension{dimChargeGroup}, []row{
+			{"IT", 35, 350, 3},
+			{"PH", 7, 70, 1},
+		}},
+		{"chargerole", []*aggregateDimension{dimChargeRole}, []row{
+			{"CERNBox Project Spaces", 30, 300, 2},
+			{"Primary-Account", 12, 120, 2},
+		}},
+		{"simplerole", []*aggregateDimension{dimSimpleRole}, []row{
+			{"CERNBox Home Directories", 12, 120, 2},
+			{"CERNBox Project Spaces", 30, 300, 2},
+		}},
+		{"department", []*aggregateDimension{dimDepartment}, []row{
+			{"EP", 7, 70, 1},
+			{"IT", 35, 350, 3},
+		}},
+		{"instance", []*aggregateDimension{dimInstance}, []row{
+			{"eoshome-a", 7, 70, 1},
+			{"eoshome-j", 5, 50, 1},
+			{"eosproject-c", 10, 100, 1},
+			{"eosproject-d", 20, 200, 1},
+		}},
+		{"accounttype", []*aggregateDimension{dimAccountType}, []row{
+			{"Primary-Account", 35, 350, 3},
+			{"Secondary-Account", 7, 70, 1},
+		}},
+		{"chargegroup and chargerole", []*aggregateDimension{dimChargeGroup, dimChargeRole}, []row{
+			{"IT|CERNBox Project Spaces", 30, 300, 2},
+			{"IT|Primary-Account", 5, 50, 1},
+			{"PH|Primary-Account", 7, 70, 1},
+		}},
+		{"chargegroup and simplerole", []*aggregateDimension{dimChargeGroup, dimSimpleRole}, []row{
+			{"IT|CERNBox Home Directories", 5, 50, 1},
+			{"IT|CERNBox Project Spaces", 30, 300, 2},
+			{"PH|CERNBox Home Directories", 7, 70, 1},
+		}},
+		{"department, instance and accounttype", []*aggregateDimension{dimDepartment, dimInstance, dimAccountType}, []row{
+			{"EP|eoshome-a|Secondary-Account", 7, 70, 1},
+			{"IT|eoshome-j|Primary-Account", 5, 50, 1},
+			{"IT|eosproject-c|Primary-Account", 10, 100, 1},
+			{"IT|eosproject-d|Primary-Account", 20, 200, 1},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := []row{}
+			for _, r := range aggregate(spaces, nil, tt.dims...) {
+				got = append(got, row{strings.Join(r.keys, "|"), r.quota.UsedBytes, r.quota.AvailableBytes, r.spaces})
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("aggregate() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestAggregateRegressions covers the bugs of the aggregations replaced by
+// the engine: sums added to a copy of the quota and never stored, the first
+// space of a group counted twice and spaces of one node counted once per path.
+func TestAggregateRegressions(t *testing.T) {
+	tests := []struct {
+		name      string
+		spaces    []*projectInfo
+		dims      []*aggregateDimension
+		used, max int
+	}{
+		{
+			name: "sums are kept for every space of a group",
+			spaces: []*projectInfo{
+				testSpace("a", "eoshome-a", "/eos/user/a/a", 1, 10, "IT", "r"),
+				testSpace("b", "eoshome-b", "/eos/user/b/b", 2, 20, "IT", "r"),
+				testSpace("c", "eoshome-c", "/eos/user/c/c", 4, 40, "IT", "r"),
+			},
+			dims: []*aggregateDimension{dimChargeGroup, dimChargeRole},
+			used: 7, max: 70,
+		},
+		{
+			name: "first space of a group is counted once",
+			spaces: []*projectInfo{
+				testSpace("a", "eoshome-a", "/eos/user/a/a", 1, 10, "IT", "r"),
+			},
+			dims: []*aggregateDimension{dimChargeGroup},
+			used: 1, max: 10,
+		},
+		{
+			name: "a node shared by several spaces is counted once",
+			spaces: []*projectInfo{
+				testSpace("svc", "eosproject-c", "/eos/project/c/one", 3, 30, "IT", "r"),
+				testSpace("svc", "eosproject-c", "/eos/project/c/two", 3, 30, "IT", "r"),
+			},
+			dims: []*aggregateDimension{dimChargeGroup},
+			used: 3, max: 30,
+		},
+		{
+			name: "nodes with the same usage are not merged",
+			spaces: []*projectInfo{
+				testSpace("a", "eoshome-a", "/eos/user/a/a", 3, 30, "IT", "r"),
+				testSpace("a", "eosproject-a", "/eos/project/a/a", 3, 30, "IT", "r"),
+			},
+			dims: []*aggregateDimension{dimChargeGroup},
+			used: 6, max: 60,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rows := aggregate(tt.spaces, nil, tt.dims...)
+			if len(rows) != 1 {
+				t.Fatalf("aggregate() returned %d rows, want 1", len(rows))
+			}
+			if rows[0].quota.UsedBytes != tt.used || rows[0].quota.AvailableBytes != tt.max {
+				t.Errorf("aggregate() = used %d max %d, want used %d max %d", rows[0].quota.UsedBytes, rows[0].quota.AvailableBytes, tt.used, tt.max)
+			}
+		})
+	}
+}
+
+func TestAggregateCost(t *testing.T) {
+	model := &costModel{Currency: "CHF", costPlan: costPlan{Rate: 1, Basis: "used", FreeAllowance: "1TB"}}
+	spaces := []*projectInfo{
+		testSpace("svc", "eosproject-c", "/eos/project/c/one", 3e12, 10e12, "IT", "r"),
+		testSpace("svc", "eosproject-c", "/eos/project/c/two", 3e12, 10e12, "IT", "r"),
+		testSpace("jdoe", "eoshome-j", "/eos/user/j/jdoe", 2e12, 10e12, "IT", "r"),
+	}
+	// the free allowance applies once per quota node: (3-1) + (2-1)
+	rows := aggregate(spaces, model, dimChargeGroup)
+	if len(rows) != 1 {
+		t.Fatalf("aggregate() returned %d rows, want 1", len(rows))
+	}
+	if rows[0].cost != 3 {
+		t.Errorf("aggregate() cost = %v, want 3", rows[0].cost)
+	}
+}
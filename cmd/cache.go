@@ -0,0 +1,460 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	bolt "go.etcd.io/bbolt"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+// buckets of the local cache
+const (
+	cacheBucketUID    = "uid"    // uid => username
+	cacheBucketUser   = "user"   // username => userInfo
+	cacheBucketCharge = "charge" // account => chargeInfo
+	cacheBucketSID    = "sid"    // group SID => e-group name, empty if the SID is not an e-group
+)
+
+var cacheBuckets = []string{cacheBucketUID, cacheBucketUser, cacheBucketCharge, cacheBucketSID}
+
+var noCache bool
+
+func init() {
+	viper.SetDefault("cache_file", "/var/cache/cernboxcop/cache.db")
+	viper.SetDefault("cache_ttl_uid", "168h")
+	viper.SetDefault("cache_ttl_user", "24h")
+	viper.SetDefault("cache_ttl_charge", "24h")
+	viper.SetDefault("cache_ttl_sid", "168h")
+
+	rootCmd.PersistentFlags().BoolVar(&noCache, "no-cache", false, "do not use the local cache for LDAP, uid and charge lookups")
+
+	rootCmd.AddCommand(cacheCmd)
+	cacheCmd.AddCommand(cacheStatsCmd)
+	cacheCmd.AddCommand(cacheGetCmd)
+	cacheCmd.AddCommand(cacheInvalidateCmd)
+	cacheCmd.AddCommand(cacheWarmCmd)
+
+	cacheInvalidateCmd.Flags().Bool("expired", false, "only remove expired entries")
+
+	cacheWarmCmd.Flags().IntP("concurrency", "c", 200, "use up to <n> concurrent connections to retrive information from external services (LDAP)")
+	cacheWarmCmd.Flags().Bool("user-also", false, "warms the cache for user home directories also")
+	cacheWarmCmd.Flags().Bool("charging", false, "warms the cache with charging information from account receiver")
+}
+
+var cacheCmd = &cobra.Command{
+	Use:   "cache",
+	Short: "Local cache for LDAP, uid and charge lookups",
+}
+
+var cacheStatsCmd = &cobra.Command{
+	Use:   "stats",
+	Short: "Shows the number of cached entries per bucket",
+	Run: func(cmd *cobra.Command, args []string) {
+		c := mustOpenCacheReadOnly()
+		defer c.db.Close()
+		cols := []string{"BUCKET", "ENTRIES", "EXPIRED", "TTL"}
+		rows := [][]string{}
+		for _, b := range cacheBuckets {
+			total, expired := c.count(b)
+			rows = append(rows, []string{b, fmt.Sprintf("%d", total), fmt.Sprintf("%d", expired), c.ttl(b).String()})
+		}
+		fmt.Printf("Cache file: %s\n\n", c.db.Path())
+		pretty(cols, rows)
+	},
+}
+
+var cacheGetCmd = &cobra.Command{
+	Use:   "get <bucket> <key>\nExample: cernboxcop cache get user gonzalhu",
+	Short: "Shows a cached entry",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 2 {
+			exit(cmd)
+		}
+
+		c := mustOpenCacheReadOnly()
+		defer c.db.Close()
+		entry, ok := c.entry(args[0], args[1])
+		if !ok {
+			er("entry not found")
+		}
+		fmt.Printf("Expires: %s (expired: %t)\n%s\n", entry.Expires.Format(time.RFC3339), entry.expired(), string(entry.Value))
+	},
+}
+
+var cacheInvalidateCmd = &cobra.Command{
+	Use:   "invalidate [bucket] [key]",
+	Short: "Removes entries from the cache. Without arguments all the buckets are emptied",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) > 2 {
+			exit(cmd)
+		}
+
+		expired, _ := cmd.Flags().GetBool("expired")
+		c := mustGetCache()
+		buckets := cacheBuckets
+		if len(args) > 0 {
+			buckets = []string{args[0]}
+		}
+
+		for _, b := range buckets {
+			var n int
+			var err error
+			if len(args) == 2 {
+				n, err = c.invalidate(b, args[1], expired)
+			} else {
+				n, err = c.invalidate(b, "", expired)
+			}
+			if err != nil {
+				er(err)
+			}
+			fmt.Printf("%s: %d entries removed\n", b, n)
+		}
+	},
+}
+
+var cacheWarmCmd = &cobra.Command{
+	Use:   "warm",
+	Short: "Resolves owners of all project spaces (and home directories) to populate the cache",
+	Run: func(cmd *cobra.Command, args []string) {
+		conc, _ := cmd.Flags().GetInt("concurrency")
+		userAlso, _ := cmd.Flags().GetBool("user-also")
+		charge, _ := cmd.Flags().GetBool("charging")
+
+		mustGetCache()
+		namespaces, err := getTopology().reportNamespaces(nil, userAlso)
+		if err != nil {
+			er(err)
+		}
+		infos, failures, err := getEOSSpaces(namespaces, -1)
+		if err != nil {
+			er(err)
+		}
+		printFailures(failures)
+
+		pool := newLDAPPool()
+		defer pool.close()
+		userInfos := getUserInfos(pool, infos, conc)
+		fillUserInfos(infos, userInfos)
+
+		if charge {
+			getCharging(infos, conc)
+		}
+
+		fmt.Fprintln(os.Stderr)
+		for _, b := range cacheBuckets {
+			total, _ := getCache().count(b)
+			fmt.Printf("%s: %d entries\n", b, total)
+		}
+	},
+}
+
+type cacheEntry struct {
+	Value   json.RawMessage
+	Expires time.Time
+}
+
+func (e *cacheEntry) expired() bool {
+	return time.Now().After(e.Expires)
+}
+
+// localCache is an on-disk key-value store with per bucket TTLs.
+// A nil *localCache is valid and behaves as an always empty cache.
+type localCache struct {
+	db *bolt.DB
+}
+
+var (
+	cacheMu       sync.Mutex
+	cacheOpened   bool
+	cacheInstance *localCache
+)
+
+// getCache opens the cache the first time it is called. It returns nil if the
+// cache is disabled or cannot be opened (i.e. another run holds the lock), in
+// which case lookups go always to the backends. The cache is locked
+// exclusively until closeCache is called or the process exits, so long
+// running commands must close it when idle.
+func getCache() *localCache {
+	cacheMu.Lock()
+	defer cacheMu.Unlock()
+	if !cacheOpened {
+		cacheOpened = true
+		cacheInstance = openCache(false)
+	}
+	return cacheInstance
+}
+
+// closeCache closes the cache opened by getCache, releasing its lock. The
+// next getCache opens it again.
+func closeCache() {
+	cacheMu.Lock()
+	defer cacheMu.Unlock()
+	if cacheInstance != nil {
+		if err := cacheInstance.db.Close(); err != nil {
+			log.Error().Msgf("error closing cache file:%s err:%+v", cacheInstance.db.Path(), err)
+		}
+	}
+	cacheInstance, cacheOpened = nil, false
+}
+
+// openCache opens cache_file. A read-only cache takes a shared lock, so it
+// can be opened by several processes at once as long as none writes to it.
+func openCache(readOnly bool) *localCache {
+	if noCache {
+		return nil
+	}
+
+	file := viper.GetString("cache_file")
+	if file == "" {
+		return nil
+	}
+
+	if !readOnly {
+		os.MkdirAll(path.Dir(file), 0755)
+	}
+	db, err := bolt.Open(file, 0600, &bolt.Options{Timeout: time.Second, ReadOnly: readOnly})
+	if err != nil {
+		log.Error().Msgf("error opening cache file:%s err:%+v", file, err)
+		fmt.Fprintf(os.Stderr, "warning: cache disabled, cannot open %s: %+v\n", file, err)
+		return nil
+	}
+	if readOnly {
+		return &localCache{db: db}
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, b := range cacheBuckets {
+			if _, err := tx.CreateBucketIfNotExists([]byte(b)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		log.Error().Msgf("error creating cache buckets file:%s err:%+v", file, err)
+		fmt.Fprintf(os.Stderr, "warning: cache disabled, cannot initialize %s: %+v\n", file, err)
+		return nil
+	}
+	return &localCache{db: db}
+}
+
+func mustGetCache() *localCache {
+	c := getCache()
+	if c == nil {
+		er("cache is disabled or cannot be opened")
+	}
+	return c
+}
+
+// mustOpenCacheReadOnly opens the cache to inspect it while another run,
+// e.g. a report, is not writing to it. It must be closed when done.
+func mustOpenCacheReadOnly() *localCache {
+	c := openCache(true)
+	if c == nil {
+		er("cache is disabled or cannot be opened")
+	}
+	return c
+}
+
+func (c *localCache) ttl(bucket string) time.Duration {
+	return viper.GetDuration("cache_ttl_" + bucket)
+}
+
+func (c *localCache) entry(bucket, key string) (*cacheEntry, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	var entry *cacheEntry
+	c.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		data := b.Get([]byte(key))
+		if data == nil {
+			return nil
+		}
+		e := &cacheEntry{}
+		if err := json.Unmarshal(data, e); err != nil {
+			log.Error().Msgf("error decoding cache entry bucket:%s key:%s err:%+v", bucket, key, err)
+			return nil
+		}
+		entry = e
+		return nil
+	})
+	return entry, entry != nil
+}
+
+// get decodes into v the value stored for key if it has not expired.
+func (c *localCache) get(bucket, key string, v interface{}) bool {
+	entry, ok := c.entry(bucket, key)
+	if !ok || entry.expired() {
+		return false
+	}
+	if err := json.Unmarshal(entry.Value, v); err != nil {
+		log.Error().Msgf("error decoding cache value bucket:%s key:%s err:%+v", bucket, key, err)
+		return false
+	}
+	return true
+}
+
+// set stores v for key. Writes from concurrent goroutines are batched.
+func (c *localCache) set(bucket, key string, v interface{}) {
+	if c == nil {
+		return
+	}
+
+	data, ok := c.encode(bucket, key, v)
+	if !ok {
+		return
+	}
+	err := c.db.Batch(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(bucket)).Put([]byte(key), data)
+	})
+	if err != nil {
+		log.Error().Msgf("error writing cache bucket:%s key:%s err:%+v", bucket, key, err)
+	}
+}
+
+// setMany stores all the values of a bucket in a single transaction.
+func (c *localCache) setMany(bucket string, values map[string]interface{}) {
+	if c == nil || len(values) == 0 {
+		return
+	}
+
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		for key, v := range values {
+			data, ok := c.encode(bucket, key, v)
+			if !ok {
+				continue
+			}
+			if err := b.Put([]byte(key), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Error().Msgf("error writing cache bucket:%s entries:%d err:%+v", bucket, len(values), err)
+	}
+}
+
+// encode returns the cache entry of v, expiring after the TTL of bucket.
+func (c *localCache) encode(bucket, key string, v interface{}) ([]byte, bool) {
+	value, err := json.Marshal(v)
+	if err != nil {
+		log.Error().Msgf("error encoding cache value bucket:%s key:%s err:%+v", bucket, key, err)
+		return nil, false
+	}
+	data, err := json.Marshal(&cacheEntry{Value: value, Expires: time.Now().Add(c.ttl(bucket))})
+	if err != nil {
+		log.Error().Msgf("error encoding cache entry bucket:%s key:%s err:%+v", bucket, key, err)
+		return nil, false
+	}
+	return data, true
+}
+
+// invalidate removes key from bucket, or the whole bucket content if key is empty.
+// If onlyExpired is set, entries still valid are kept.
+func (c *localCache) invalidate(bucket, key string, onlyExpired bool) (int, error) {
+	var removed int
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return fmt.Errorf("bucket %q does not exist", bucket)
+		}
+
+		keys := [][]byte{}
+		if key != "" {
+			keys = append(keys, []byte(key))
+		} else {
+			b.ForEach(func(k, v []byte) error {
+				keys = append(keys, append([]byte{}, k...))
+				return nil
+			})
+		}
+
+		for _, k := range keys {
+			data := b.Get(k)
+			if data == nil {
+				continue
+			}
+			if onlyExpired {
+				e := &cacheEntry{}
+				if err := json.Unmarshal(data, e); err == nil && !e.expired() {
+					continue
+				}
+			}
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+			removed++
+		}
+		return nil
+	})
+	return removed, err
+}
+
+func (c *localCache) count(bucket string) (total, expired int) {
+	if c == nil {
+		return
+	}
+
+	c.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			total++
+			e := &cacheEntry{}
+			if err := json.Unmarshal(v, e); err != nil || e.expired() {
+				expired++
+			}
+			return nil
+		})
+	})
+	return
+}
+
+// cachedUserInfo is the serializable form of a userInfo. Primary accounts are
+// their own owner, which cannot be encoded as is.
+type cachedUserInfo struct {
+	User        userInfo
+	Owner       *userInfo
+	OwnerIsSelf bool
+}
+
+func newCachedUserInfo(ui *userInfo) *cachedUserInfo {
+	c := &cachedUserInfo{User: *ui}
+	c.User.AccountOwner = nil
+	if ui.AccountOwner == ui {
+		c.OwnerIsSelf = true
+	} else if ui.AccountOwner != nil {
+		owner := *ui.AccountOwner
+		owner.AccountOwner = nil
+		c.Owner = &owner
+	}
+	return c
+}
+
+func (c *cachedUserInfo) userInfo() *userInfo {
+	ui := c.User
+	switch {
+	case c.OwnerIsSelf:
+		ui.AccountOwner = &ui
+	case c.Owner != nil:
+		ui.AccountOwner = c.Owner
+	default:
+		ui.AccountOwner = &userInfo{}
+	}
+	return &ui
+}
@@ -0,0 +1,135 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/spf13/viper"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+func init() {
+	viper.SetDefault("checkpoint_dir", "/var/lib/cernboxcop/checkpoints")
+}
+
+// Stages of the accounting pipeline, in order.
+const (
+	stageListing  = "listing"
+	stageUsers    = "users"
+	stageQuotas   = "quotas"
+	stageCharging = "charging"
+)
+
+var checkpointStages = []string{stageListing, stageUsers, stageQuotas, stageCharging}
+
+// checkpoint saves the spaces after every stage of the accounting pipeline so
+// a failed run can continue from the last completed stage.
+type checkpoint struct {
+	dir   string
+	state checkpointState
+	infos []*projectInfo // spaces of the last completed stage when resuming
+}
+
+type checkpointState struct {
+	Started    time.Time
+	Limit      int
+	Namespaces []string
+	Charge     bool
+	Stage      string // last completed stage
+	Failures   []*instanceFailure
+}
+
+// newCheckpoint returns the checkpoint of a run with the given parameters,
+// stored in <checkpoint_dir>/<name>.
+func newCheckpoint(name string, limit int, namespaces []string, charge bool) *checkpoint {
+	return &checkpoint{
+		dir:   path.Join(viper.GetString("checkpoint_dir"), name),
+		state: checkpointState{Started: time.Now(), Limit: limit, Namespaces: namespaces, Charge: charge},
+	}
+}
+
+// openCheckpoint returns the checkpoint for a new run or, if resume is set,
+// the one of the last failed run.
+func openCheckpoint(name string, resume bool, limit int, namespaces []string, charge bool) *checkpoint {
+	cp := newCheckpoint(name, limit, namespaces, charge)
+	if !resume {
+		// a new run must not be resumed from the stages of an older one
+		cp.done()
+		return cp
+	}
+	if err := cp.resume(); err != nil {
+		er(err)
+	}
+	fmt.Fprintf(os.Stderr, "Resuming run started at %s after stage %s\n", cp.state.Started.Local().Format("2006-01-02 15:04"), cp.state.Stage)
+	return cp
+}
+
+// resume loads the last completed stage. Checkpoints taken with other
+// parameters are refused, as their spaces would not match the run.
+func (c *checkpoint) resume() error {
+	state := checkpointState{}
+	if err := loadJSON(path.Join(c.dir, "state.json"), &state); err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("no checkpoint to resume in %s", c.dir)
+		}
+		return err
+	}
+	if state.Limit != c.state.Limit || strings.Join(state.Namespaces, ",") != strings.Join(c.state.Namespaces, ",") || state.Charge != c.state.Charge {
+		return fmt.Errorf("checkpoint in %s was taken with --limit=%d --namespace=%s --charging=%t, run with the same flags or without --resume",
+			c.dir, state.Limit, strings.Join(state.Namespaces, ","), state.Charge)
+	}
+
+	records := []*infoRecord{}
+	if err := loadJSON(path.Join(c.dir, state.Stage+".json"), &records); err != nil {
+		return err
+	}
+	c.state = state
+	c.infos = projectInfosFromRecords(records)
+	return nil
+}
+
+// save stores infos as the result of stage. Failing to save only loses the
+// ability to resume, so errors are logged and the run goes on.
+func (c *checkpoint) save(stage string, infos []*projectInfo) {
+	if err := os.MkdirAll(c.dir, 0755); err != nil {
+		log.Error().Msgf("error creating checkpoint dir: dir:%s err:%+v", c.dir, err)
+		return
+	}
+	if err := saveJSON(path.Join(c.dir, stage+".json"), newInfoRecords(infos)); err != nil {
+		log.Error().Msgf("error saving checkpoint: stage:%s err:%+v", stage, err)
+		return
+	}
+	c.state.Stage = stage
+	if err := saveJSON(path.Join(c.dir, "state.json"), c.state); err != nil {
+		log.Error().Msgf("error saving checkpoint state: stage:%s err:%+v", stage, err)
+	}
+}
+
+// fail records EOS instances that could not be queried. They are saved with
+// the next stage so a resumed run still reports them.
+func (c *checkpoint) fail(failures ...*instanceFailure) {
+	c.state.Failures = append(c.state.Failures, failures...)
+}
+
+// completed tells if stage was completed before resuming.
+func (c *checkpoint) completed(stage string) bool {
+	return stageIndex(stage) <= stageIndex(c.state.Stage)
+}
+
+// stageIndex returns the position of stage in checkpointStages, -1 if unknown.
+func stageIndex(stage string) int {
+	for i, s := range checkpointStages {
+		if s == stage {
+			return i
+		}
+	}
+	return -1
+}
+
+// done removes the checkpoint once the run finished.
+func (c *checkpoint) done() {
+	if err := os.RemoveAll(c.dir); err != nil {
+		log.Error().Msgf("error removing checkpoint: dir:%s err:%+v", c.dir, err)
+	}
+}
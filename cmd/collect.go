@@ -0,0 +1,85 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/spf13/viper"
+	"github.com/tj/go-spin"
+	"os"
+	"sort"
+	"sync"
+)
+
+func init() {
+	viper.SetDefault("eos_workers", 8)
+	viper.SetDefault("eos_list_timeout", "30s")
+	viper.SetDefault("eos_quota_timeout", "60s")
+}
+
+// instanceFailure is an EOS instance that could not be queried while
+// collecting accounting information. The spaces or quotas of the instance are
+// missing from the report, which is then incomplete.
+type instanceFailure struct {
+	Instance  string
+	Operation string
+	Message   string
+}
+
+func (f *instanceFailure) Error() string {
+	return fmt.Sprintf("%s %s: %s", f.Operation, f.Instance, f.Message)
+}
+
+// eachInstance runs fn for every instance using up to eos_workers goroutines.
+// A failing instance does not stop the others, its error is returned as an
+// instanceFailure for operation op.
+func eachInstance(op string, instances []string, fn func(mgm string) error) []*instanceFailure {
+	workers := viper.GetInt("eos_workers")
+	if workers < 1 {
+		workers = 1
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	failures := []*instanceFailure{}
+	throttle := make(chan int, workers)
+	s := spin.New()
+	done := 0
+	for _, mgm := range instances {
+		throttle <- 1
+		wg.Add(1)
+		go func(mgm string) {
+			defer wg.Done()
+			defer func() {
+				<-throttle
+			}()
+
+			err := fn(mgm)
+
+			mu.Lock()
+			defer mu.Unlock()
+			done++
+			fmt.Fprintf(os.Stderr, "\r %s %s [%d/%d]", s.Next(), op, done, len(instances))
+			if err != nil {
+				log.Error().Msgf("error querying EOS: op:%s instance:%s err:%+v", op, mgm, err)
+				failures = append(failures, &instanceFailure{Instance: mgm, Operation: op, Message: err.Error()})
+			}
+		}(mgm)
+	}
+	wg.Wait()
+	fmt.Fprintln(os.Stderr)
+
+	sort.Slice(failures, func(i, j int) bool {
+		return failures[i].Instance < failures[j].Instance
+	})
+	return failures
+}
+
+// printFailures warns about the instances missing from a report.
+func printFailures(failures []*instanceFailure) {
+	if len(failures) == 0 {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "%d EOS instances could not be queried, the report is INCOMPLETE:\n", len(failures))
+	for _, f := range failures {
+		fmt.Fprintf(os.Stderr, "  %s\n", f)
+	}
+}
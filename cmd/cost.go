@@ -0,0 +1,292 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/dustin/go-humanize"
+	"github.com/leekchan/accounting"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"math"
+	"os"
+	"path"
+	"strings"
+)
+
+const bytesPerTB = float64(1000000000000)
+
+func init() {
+	accountingCmd.AddCommand(accountingCostCmd)
+	accountingCostCmd.AddCommand(accountingCostExplainCmd)
+
+	accountingCostExplainCmd.Flags().StringP("report", "r", ".", "directory containing the accounting.txt of the report run")
+	accountingCostExplainCmd.Flags().Float64P("cost", "", 2.20, "cost factor for CHF/TBMonth used when cost_model does not define a rate")
+}
+
+var accountingCostCmd = &cobra.Command{
+	Use:   "cost",
+	Short: "Cost model used in accounting reports",
+}
+
+var accountingCostExplainCmd = &cobra.Command{
+	Use:   "explain <account>",
+	Short: "Shows how the cost of the spaces of an account is computed",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 1 {
+			exit(cmd)
+		}
+
+		account := strings.TrimSpace(args[0])
+		report, _ := cmd.Flags().GetString("report")
+		factorPerTB, _ := cmd.Flags().GetFloat64("cost")
+		model := getCostModel(factorPerTB)
+
+		file := path.Join(report, "accounting.txt")
+		fd, err := os.Open(file)
+		if err != nil {
+			er(err)
+		}
+		defer fd.Close()
+		rows, err := parseReport(fd)
+		if err != nil {
+			er(fmt.Sprintf("error parsing %s: %+v", file, err))
+		}
+
+		// one explanation per quota node, attributed to the lowest path as in the aggregates
+		spaces := []*projectInfo{}
+		for _, info := range reportInfos(rows) {
+			if info.userInfo.Account == account {
+				spaces = append(spaces, info)
+			}
+		}
+		nodes := uniqueQuotaNodes(spaces)
+		if len(nodes) == 0 {
+			er(fmt.Sprintf("account %q not found in %s", account, file))
+		}
+
+		fmt.Printf("The free allowance and the tiers apply to every quota node on its own.\n\n")
+		var total float64
+		for _, node := range nodes {
+			in := newCostInput(node)
+			amount, steps := model.explain(in)
+			total += amount
+
+			fmt.Printf("%s %s\n", node.FileInfo.Instance, in.path)
+			for i, s := range steps {
+				fmt.Printf("  %d. %s\n", i+1, s)
+			}
+			fmt.Printf("  = %s\n\n", model.format(amount))
+		}
+		fmt.Printf("Total for %s: %s\n", account, model.format(total))
+	},
+}
+
+// costModel computes the monthly cost of a quota node. Every node is charged
+// on its own: the free allowance and the tiers apply to the bytes of each
+// node, not to the total of a charge group, which is the sum of the costs of
+// its nodes. It is read from the cost_model section of the config file:
+//
+//	[cost_model]
+//	currency = "CHF"
+//	rate = 2.20                  # per TB and month
+//	basis = "used"               # or "quota"
+//	free_allowance = "0"         # subtracted from every quota node
+//	[[cost_model.tiers]]         # optional, replaces rate, per quota node
+//	up_to = "100TB"
+//	rate = 2.20
+//	[[cost_model.tiers]]
+//	rate = 1.50                  # no up_to: rest of the bytes
+//	[cost_model.kinds.home]      # plan for a namespace of the eos topology
+//	free_allowance = "1TB"
+//	[cost_model.groups.IT]       # plan for a charge group, takes precedence over kinds
+//	basis = "quota"
+//
+// Unset fields of a plan fall back to the ones of the top level plan.
+type costModel struct {
+	Currency string `mapstructure:"currency"`
+	costPlan `mapstructure:",squash"`
+	Kinds    map[string]*costPlan `mapstructure:"kinds"`
+	Groups   map[string]*costPlan `mapstructure:"groups"`
+}
+
+type costPlan struct {
+	Rate          float64     `mapstructure:"rate"`
+	Basis         string      `mapstructure:"basis"`
+	FreeAllowance string      `mapstructure:"free_allowance"`
+	Tiers         []*costTier `mapstructure:"tiers"`
+}
+
+type costTier struct {
+	UpTo string  `mapstructure:"up_to"`
+	Rate float64 `mapstructure:"rate"`
+}
+
+// costInput is the information about a quota node needed to compute its cost.
+type costInput struct {
+	account     string
+	path        string
+	chargeGroup string
+	used, quota int
+}
+
+func newCostInput(p *projectInfo) *costInput {
+	return &costInput{
+		account:     p.userInfo.Account,
+		path:        p.FileInfo.File,
+		chargeGroup: p.chargeInfo.ChargeGroup,
+		used:        p.QuotaInfo.UsedBytes,
+		quota:       p.QuotaInfo.AvailableBytes,
+	}
+}
+
+// kind returns the namespace of the space, used to pick a plan from cost_model.kinds.
+func (in *costInput) kind() string {
+	if ns := getTopology().namespaceOfPath(in.path); ns != nil {
+		return ns.Name
+	}
+	return "unknown"
+}
+
+// getCostModel loads the cost model from the config. defaultRate, in
+// currency per TB and month, is used if the config does not define a rate.
+func getCostModel(defaultRate float64) *costModel {
+	m := &costModel{}
+	if err := viper.UnmarshalKey("cost_model", m); err != nil {
+		er(fmt.Sprintf("error parsing cost_model: %+v", err))
+	}
+
+	if m.Currency == "" {
+		m.Currency = "CHF"
+	}
+	if m.Rate == 0 && len(m.Tiers) == 0 {
+		m.Rate = defaultRate
+	}
+	if m.Basis == "" {
+		m.Basis = "used"
+	}
+
+	// validate the plans early so reports do not fail half way
+	plans := []*costPlan{&m.costPlan}
+	for _, p := range m.Kinds {
+		plans = append(plans, p)
+	}
+	for _, p := range m.Groups {
+		plans = append(plans, p)
+	}
+	for _, p := range plans {
+		if p.Basis != "" && p.Basis != "used" && p.Basis != "quota" {
+			er(fmt.Sprintf("cost_model: invalid basis %q, must be used or quota", p.Basis))
+		}
+		if p.FreeAllowance != "" {
+			if _, err := humanize.ParseBytes(p.FreeAllowance); err != nil {
+				er(fmt.Sprintf("cost_model: invalid free_allowance %q: %+v", p.FreeAllowance, err))
+			}
+		}
+		for _, t := range p.Tiers {
+			if t.UpTo != "" {
+				if _, err := humanize.ParseBytes(t.UpTo); err != nil {
+					er(fmt.Sprintf("cost_model: invalid tier up_to %q: %+v", t.UpTo, err))
+				}
+			}
+		}
+	}
+	return m
+}
+
+// plan returns the plan applying to in, and a description of where it comes from.
+func (m *costModel) plan(in *costInput) (*costPlan, string) {
+	p := m.costPlan
+	source := "default plan"
+
+	merge := func(o *costPlan) {
+		if o.Rate != 0 || len(o.Tiers) > 0 {
+			p.Rate, p.Tiers = o.Rate, o.Tiers
+		}
+		if o.Basis != "" {
+			p.Basis = o.Basis
+		}
+		if o.FreeAllowance != "" {
+			p.FreeAllowance = o.FreeAllowance
+		}
+	}
+
+	if o, ok := m.Kinds[in.kind()]; ok {
+		merge(o)
+		source = fmt.Sprintf("plan for %s spaces", in.kind())
+	}
+	// viper lower cases map keys
+	if o, ok := m.Groups[strings.ToLower(in.chargeGroup)]; ok {
+		merge(o)
+		source = fmt.Sprintf("plan for charge group %s", in.chargeGroup)
+	}
+	return &p, source
+}
+
+func (m *costModel) cost(in *costInput) float64 {
+	amount, _ := m.explain(in)
+	return amount
+}
+
+// explain computes the monthly cost of in, returning the steps followed.
+func (m *costModel) explain(in *costInput) (float64, []string) {
+	p, source := m.plan(in)
+	steps := []string{fmt.Sprintf("using %s", source)}
+
+	bytes := in.used
+	if p.Basis == "quota" {
+		bytes = in.quota
+	}
+	steps = append(steps, fmt.Sprintf("charged on %s of the quota node: %s", p.Basis, humanQuota(bytes)))
+
+	if p.FreeAllowance != "" {
+		free, _ := humanize.ParseBytes(p.FreeAllowance)
+		bytes -= int(free)
+		if bytes < 0 {
+			bytes = 0
+		}
+		steps = append(steps, fmt.Sprintf("minus free allowance of %s: %s", humanQuota(int(free)), humanQuota(bytes)))
+	}
+
+	if len(p.Tiers) == 0 {
+		amount := float64(bytes) / bytesPerTB * p.Rate
+		steps = append(steps, fmt.Sprintf("%s at %s/TB-month: %s", humanQuota(bytes), m.format(p.Rate), m.format(amount)))
+		return amount, steps
+	}
+
+	var amount float64
+	remaining := bytes
+	lower := 0
+	for _, t := range p.Tiers {
+		if remaining <= 0 {
+			break
+		}
+		size := remaining
+		if t.UpTo != "" {
+			upTo, _ := humanize.ParseBytes(t.UpTo)
+			size = int(math.Min(float64(remaining), float64(int(upTo)-lower)))
+			lower = int(upTo)
+		}
+		if size <= 0 {
+			continue
+		}
+		tierAmount := float64(size) / bytesPerTB * t.Rate
+		amount += tierAmount
+		remaining -= size
+		steps = append(steps, fmt.Sprintf("tier up to %s: %s at %s/TB-month: %s", tierLimit(t), humanQuota(size), m.format(t.Rate), m.format(tierAmount)))
+	}
+	if remaining > 0 {
+		steps = append(steps, fmt.Sprintf("%s above the last tier are not charged", humanQuota(remaining)))
+	}
+	return amount, steps
+}
+
+func tierLimit(t *costTier) string {
+	if t.UpTo == "" {
+		return "unlimited"
+	}
+	return t.UpTo
+}
+
+func (m *costModel) format(amount float64) string {
+	ac := accounting.Accounting{Symbol: m.Currency, Precision: 2}
+	return ac.FormatMoney(amount)
+}
@@ -36,9 +36,10 @@ var eosQuotaCmd = &cobra.Command{
 }
 
 func getEosQuotaForUser(username string) *eosclient.QuotaInfo {
-	ctx, _ := context.WithTimeout(getCtx(), time.Second*60)
+	ctx, cancel := context.WithTimeout(getCtx(), time.Second*60)
+	defer cancel()
 	eos := getEOSForUser(username)
-	quota, err := eos.GetQuota(ctx, username, "/eos/user/")
+	quota, err := eos.GetQuota(ctx, username, getTopology().quotaPrefix("home"))
 	if err != nil {
 		er(err)
 	}
@@ -46,9 +47,10 @@ func getEosQuotaForUser(username string) *eosclient.QuotaInfo {
 }
 
 func getEosQuota(mgm, username string) *eosclient.QuotaInfo {
-	ctx, _ := context.WithTimeout(getCtx(), time.Second*60)
+	ctx, cancel := context.WithTimeout(getCtx(), time.Second*60)
+	defer cancel()
 	eos := getEOS(mgm)
-	quota, err := eos.GetQuota(ctx, username, "/eos/user/")
+	quota, err := eos.GetQuota(ctx, username, getTopology().quotaPrefix("home"))
 	if err != nil {
 		er(err)
 	}
@@ -56,10 +58,11 @@ func getEosQuota(mgm, username string) *eosclient.QuotaInfo {
 }
 
 func getEOSQuota(mgm string, uid uint64) *eosclient.QuotaInfo {
-	ctx, _ := context.WithTimeout(getCtx(), time.Second*10)
+	ctx, cancel := context.WithTimeout(getCtx(), time.Second*10)
+	defer cancel()
 	eos := getEOS(mgm)
 	username := fmt.Sprintf("%d", uid)
-	quota, err := eos.GetQuota(ctx, username, "/eos/user/")
+	quota, err := eos.GetQuota(ctx, username, getTopology().quotaPrefix("home"))
 	if err != nil {
 		er(err)
 	}
@@ -67,10 +70,11 @@ func getEOSQuota(mgm string, uid uint64) *eosclient.QuotaInfo {
 }
 
 func getEOSProjectQuota(mgm string, uid uint64) *eosclient.QuotaInfo {
-	ctx, _ := context.WithTimeout(getCtx(), time.Second*60)
+	ctx, cancel := context.WithTimeout(getCtx(), time.Second*60)
+	defer cancel()
 	eos := getEOS(mgm)
 	username := fmt.Sprintf("%d", uid)
-	quota, err := eos.GetQuota(ctx, username, "/eos/project/")
+	quota, err := eos.GetQuota(ctx, username, getTopology().quotaPrefix("project"))
 	if err != nil {
 		er(err)
 	}
@@ -0,0 +1,237 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/spf13/cobra"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	rootCmd.AddCommand(exporterCmd)
+
+	exporterCmd.Flags().String("listen", ":9473", "address to expose the /metrics endpoint")
+	exporterCmd.Flags().Duration("interval", time.Hour, "time between refreshes of the storage usage")
+	exporterCmd.Flags().IntP("concurrency", "c", 200, "use up to <n> concurrent connections to retrive information from external services (LDAP)")
+	exporterCmd.Flags().Bool("user-also", false, "exports user home directories also")
+	exporterCmd.Flags().Bool("charging", false, "obtains charging information from account receiver")
+}
+
+var exporterCmd = &cobra.Command{
+	Use:   "exporter",
+	Short: "Exposes storage usage per instance, user and project as Prometheus metrics",
+	Run: func(cmd *cobra.Command, args []string) {
+		listen, _ := cmd.Flags().GetString("listen")
+		interval, _ := cmd.Flags().GetDuration("interval")
+		conc, _ := cmd.Flags().GetInt("concurrency")
+		userAlso, _ := cmd.Flags().GetBool("user-also")
+		charge, _ := cmd.Flags().GetBool("charging")
+
+		// an invalid topology exits now and not in the middle of a refresh
+		getTopology()
+
+		e := &exporter{concurrency: conc, userAlso: userAlso, charging: charge, errors: map[string]int{}}
+		go func() {
+			for {
+				if err := e.refresh(); err != nil {
+					e.countFailure(err)
+				}
+				time.Sleep(interval)
+			}
+		}()
+
+		http.Handle("/metrics", e)
+		log.Info().Msgf("exporter listening on %s", listen)
+		if err := http.ListenAndServe(listen, nil); err != nil {
+			er(err)
+		}
+	},
+}
+
+// exporter periodically runs the accounting collection stage and serves the
+// last successful result. Backend errors and failed refreshes are counted
+// instead of aborting.
+// The local cache is locked while refreshing and released in between, runs
+// of other commands during a refresh go without cache. To avoid it, run the
+// exporter with --no-cache or with its own cache_file.
+type exporter struct {
+	concurrency int
+	userAlso    bool
+	charging    bool
+
+	mu              sync.Mutex
+	quotas          []*projectInfo
+	errors          map[string]int // backend => errors since start
+	failures        int            // refreshes that failed since start
+	refreshDuration time.Duration
+	lastRefresh     time.Time
+}
+
+func (e *exporter) countError(backend string, err error) {
+	log.Error().Msgf("exporter: error from backend:%s err:%+v", backend, err)
+	e.mu.Lock()
+	e.errors[backend]++
+	e.mu.Unlock()
+}
+
+func (e *exporter) countErrors(backend string, n int) {
+	log.Error().Msgf("exporter: %d lookups failed in backend:%s", n, backend)
+	e.mu.Lock()
+	e.errors[backend] += n
+	e.mu.Unlock()
+}
+
+func (e *exporter) countFailure(err error) {
+	log.Error().Msgf("exporter: refresh failed err:%+v", err)
+	e.mu.Lock()
+	e.failures++
+	e.mu.Unlock()
+}
+
+// refresh collects the storage usage. If it fails, the previous result keeps
+// being served.
+func (e *exporter) refresh() error {
+	start := time.Now()
+	// release the cache lock until the next refresh
+	defer closeCache()
+
+	namespaces, err := getTopology().reportNamespaces(nil, e.userAlso)
+	if err != nil {
+		return err
+	}
+	infos, failures, err := getEOSSpaces(namespaces, -1)
+	if err != nil {
+		return err
+	}
+	for _, f := range failures {
+		e.countError("eos", f)
+	}
+
+	pool := newLDAPPool()
+	userInfos := getUserInfos(pool, infos, e.concurrency)
+	pool.close()
+	fillUserInfos(infos, userInfos)
+	if n := pool.failureCount(); n > 0 {
+		e.countErrors("ldap", n)
+	}
+
+	nodes, failures := getQuotas(getInstances(infos)...)
+	for _, f := range failures {
+		e.countError("eos", f)
+	}
+	fillQuotas(infos, nodes)
+
+	if e.charging {
+		accounts := make([]string, 0, len(infos))
+		for _, info := range infos {
+			accounts = append(accounts, info.userInfo.Account)
+		}
+		client := newReceiverClient("")
+		for _, chunk := range chunkAccounts(accounts, 1000) {
+			charges, err := client.charging(chunk)
+			if err != nil {
+				e.countError("charging", err)
+				continue
+			}
+			fillCharging(infos, charges)
+		}
+		fillChargeRoles(infos)
+
+		// read on every refresh, so changes apply without a restart
+		overrides, err := readChargeOverrides()
+		if err != nil {
+			return err
+		}
+		applyChargeOverrides(infos, overrides)
+	}
+
+	// several spaces can share the same quota node and Prometheus rejects duplicated series
+	quotas := []*projectInfo{}
+	for _, info := range uniqueQuotaNodes(infos) {
+		if info.userInfo.Account != "" {
+			quotas = append(quotas, info)
+		}
+	}
+
+	e.mu.Lock()
+	e.quotas = quotas
+	e.refreshDuration = time.Since(start)
+	e.lastRefresh = time.Now()
+	e.mu.Unlock()
+	return nil
+}
+
+func (e *exporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	var buf bytes.Buffer
+	writeMetricHeader(&buf, "cernbox_quota_used_bytes", "gauge", "Logical bytes used by the quota node of an account.")
+	for _, info := range e.quotas {
+		fmt.Fprintf(&buf, "cernbox_quota_used_bytes%s %d\n", quotaLabels(info), info.QuotaInfo.UsedBytes)
+	}
+	writeMetricHeader(&buf, "cernbox_quota_max_bytes", "gauge", "Logical bytes allowed by the quota node of an account.")
+	for _, info := range e.quotas {
+		fmt.Fprintf(&buf, "cernbox_quota_max_bytes%s %d\n", quotaLabels(info), info.QuotaInfo.AvailableBytes)
+	}
+
+	writeMetricHeader(&buf, "cernboxcop_refresh_duration_seconds", "gauge", "Time spent collecting storage usage in the last refresh.")
+	fmt.Fprintf(&buf, "cernboxcop_refresh_duration_seconds %f\n", e.refreshDuration.Seconds())
+	writeMetricHeader(&buf, "cernboxcop_last_refresh_timestamp_seconds", "gauge", "Unix time of the last completed refresh.")
+	if !e.lastRefresh.IsZero() {
+		fmt.Fprintf(&buf, "cernboxcop_last_refresh_timestamp_seconds %d\n", e.lastRefresh.Unix())
+	}
+
+	writeMetricHeader(&buf, "cernboxcop_refresh_failures_total", "counter", "Refreshes that failed, the previous result is served meanwhile.")
+	fmt.Fprintf(&buf, "cernboxcop_refresh_failures_total %d\n", e.failures)
+
+	writeMetricHeader(&buf, "cernboxcop_backend_errors_total", "counter", "Errors returned by backends while refreshing.")
+	backends := []string{"charging", "eos", "ldap"}
+	for _, b := range backends {
+		fmt.Fprintf(&buf, "cernboxcop_backend_errors_total{backend=%q} %d\n", b, e.errors[b])
+	}
+
+	// last, to include the time spent rendering the other metrics
+	writeMetricHeader(&buf, "cernboxcop_scrape_duration_seconds", "gauge", "Time spent serving this scrape.")
+	fmt.Fprintf(&buf, "cernboxcop_scrape_duration_seconds %f\n", time.Since(start).Seconds())
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(buf.Bytes())
+}
+
+func writeMetricHeader(buf *bytes.Buffer, name, kind, help string) {
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func quotaLabels(info *projectInfo) string {
+	labels := map[string]string{
+		"eos_instance": info.FileInfo.Instance, // instance is set by Prometheus to the scraped target
+		"account":      info.userInfo.Account,
+		"charge_group": info.chargeInfo.ChargeGroup,
+		"charge_role":  info.chargeInfo.ChargeRole,
+	}
+
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", k, escapeLabelValue(labels[k])))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// escapeLabelValue escapes a label value following the Prometheus text exposition format.
+func escapeLabelValue(v string) string {
+	v = strings.ReplaceAll(v, `\`, `\\`)
+	v = strings.ReplaceAll(v, "\n", `\n`)
+	return strings.ReplaceAll(v, `"`, `\"`)
+}
@@ -0,0 +1,238 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+	"gopkg.in/ldap.v3"
+	"os"
+	"sort"
+	"strings"
+)
+
+func init() {
+	rootCmd.AddCommand(groupCmd)
+	groupCmd.AddCommand(groupMembersCmd)
+
+	groupMembersCmd.Flags().Bool("tree", false, "shows the nested groups as a tree instead of the list of users")
+	groupMembersCmd.Flags().Int("max-depth", 0, "expands nested groups up to <n> levels. 0 means no limit")
+}
+
+var groupCmd = &cobra.Command{
+	Use:   "group",
+	Short: "E-group Info",
+}
+
+var groupMembersCmd = &cobra.Command{
+	Use:   "members <egroup>",
+	Short: "Lists the members of an e-group, expanding nested groups",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 1 {
+			exit(cmd)
+		}
+
+		name := strings.TrimSpace(args[0])
+		tree, _ := cmd.Flags().GetBool("tree")
+		maxDepth, _ := cmd.Flags().GetInt("max-depth")
+
+		l := getLDAP()
+		defer l.Close()
+
+		dn, err := getEGroupDN(l, name)
+		if err != nil {
+			er(err)
+		}
+		if dn == "" {
+			er(fmt.Sprintf("e-group %q not found", name))
+		}
+
+		e := &groupExpander{l: l, maxDepth: maxDepth, expanded: map[string]*groupNode{}, direct: map[string]*groupDirect{}, stack: map[string]*groupNode{}}
+		root, err := e.expand(name, dn, 0)
+		if err != nil {
+			er(err)
+		}
+
+		users := root.users()
+		if tree {
+			printGroupTree(root, "", map[*groupNode]bool{}, map[*groupNode]bool{})
+		} else {
+			cols := []string{"Account", "Type", "Name", "Department", "Group", "Section", "Mail", "Via"}
+			rows := [][]string{}
+			for _, m := range users {
+				ui := m.info
+				rows = append(rows, []string{ui.Account, ui.AccountType, ui.Name, ui.Department, ui.Group, ui.Section, ui.Mail, strings.Join(m.via, " > ")})
+			}
+			pretty(cols, rows)
+		}
+
+		for _, c := range e.cycles {
+			fmt.Fprintf(os.Stderr, "Warning: membership cycle %s\n", strings.Join(c, " > "))
+		}
+		fmt.Fprintf(os.Stderr, "%d users in %d groups\n", len(users), len(e.direct))
+	},
+}
+
+// groupNode is a group with its direct user members and nested groups. Nodes
+// are shared by all the groups containing them, so the nested groups form a
+// graph that may have cycles: walking it must track the current ancestry.
+type groupNode struct {
+	name      string
+	dn        string
+	members   []*userInfo
+	groups    []*groupNode
+	truncated bool // max-depth reached, not expanded
+}
+
+// groupExpander expands nested groups. A group found several times is
+// expanded once, or once per remaining depth with a max-depth, so a group
+// first found deep in the tree is expanded again if found closer to the root.
+// A group found again while expanding itself is a cycle and links back to the
+// node being expanded.
+type groupExpander struct {
+	l        *ldap.Conn
+	maxDepth int
+	expanded map[string]*groupNode   // dn and remaining depth => node
+	direct   map[string]*groupDirect // dn => direct members, searched once
+	stack    map[string]*groupNode   // dn => node of the groups being expanded
+	path     []string                // names of the groups being expanded
+	cycles   [][]string
+}
+
+func (e *groupExpander) expand(name, dn string, depth int) (*groupNode, error) {
+	if node, ok := e.stack[dn]; ok {
+		e.cycles = append(e.cycles, append(append([]string{}, e.path...), name))
+		return node, nil
+	}
+	if e.maxDepth > 0 && depth > e.maxDepth {
+		return &groupNode{name: name, dn: dn, truncated: true}, nil
+	}
+	key := dn
+	if e.maxDepth > 0 {
+		key = fmt.Sprintf("%s\x00%d", dn, e.maxDepth-depth)
+	}
+	if node, ok := e.expanded[key]; ok {
+		return node, nil
+	}
+
+	direct, err := e.directMembers(dn)
+	if err != nil {
+		return nil, err
+	}
+	node := &groupNode{name: name, dn: dn, members: direct.users}
+	e.expanded[key] = node
+	e.stack[dn] = node
+	e.path = append(e.path, name)
+	defer func() {
+		delete(e.stack, dn)
+		e.path = e.path[:len(e.path)-1]
+	}()
+
+	for _, entry := range direct.groups {
+		child, err := e.expand(entry.GetAttributeValue("cn"), entry.DN, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		node.groups = append(node.groups, child)
+	}
+	return node, nil
+}
+
+// groupDirect is the direct members of a group.
+type groupDirect struct {
+	users  []*userInfo
+	groups []*ldap.Entry
+}
+
+// directMembers searches the direct members of the group dn, once per group.
+func (e *groupExpander) directMembers(dn string) (*groupDirect, error) {
+	if d, ok := e.direct[dn]; ok {
+		return d, nil
+	}
+
+	d := &groupDirect{}
+	users, err := searchGroupMembers(e.l, dn, "(objectClass=user)", false, []string{})
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range users {
+		d.users = append(d.users, userInfoFromEntry(entry))
+	}
+	if d.groups, err = searchGroupMembers(e.l, dn, "(objectClass=group)", false, []string{"cn"}); err != nil {
+		return nil, err
+	}
+	e.direct[dn] = d
+	return d, nil
+}
+
+// groupMember is a user and the nested groups it was found through.
+type groupMember struct {
+	info *userInfo
+	via  []string
+}
+
+// users returns the distinct users of the group and its nested groups,
+// sorted by account, with the shortest path of groups to each of them.
+func (n *groupNode) users() []*groupMember {
+	found := map[string]*groupMember{}
+	seen := map[*groupNode]bool{}
+	level := []*groupNode{n}
+	paths := map[*groupNode][]string{n: {n.name}}
+	// breadth first so the first path found is the shortest
+	for len(level) > 0 {
+		next := []*groupNode{}
+		for _, g := range level {
+			if seen[g] {
+				continue
+			}
+			seen[g] = true
+			for _, ui := range g.members {
+				if _, ok := found[ui.Account]; !ok {
+					found[ui.Account] = &groupMember{info: ui, via: paths[g]}
+				}
+			}
+			for _, c := range g.groups {
+				if _, ok := paths[c]; !ok {
+					paths[c] = append(append([]string{}, paths[g]...), c.name)
+				}
+				next = append(next, c)
+			}
+		}
+		level = next
+	}
+
+	members := make([]*groupMember, 0, len(found))
+	for _, m := range found {
+		members = append(members, m)
+	}
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].info.Account < members[j].info.Account
+	})
+	return members
+}
+
+// printGroupTree prints n and its nested groups. Groups already printed are
+// not expanded again, groups containing themselves through ancestors are
+// cycles.
+func printGroupTree(n *groupNode, indent string, printed, ancestors map[*groupNode]bool) {
+	switch {
+	case ancestors[n]:
+		fmt.Printf("%s%s (cycle, not expanded)\n", indent, n.name)
+		return
+	case n.truncated:
+		fmt.Printf("%s%s (max depth reached, not expanded)\n", indent, n.name)
+		return
+	case printed[n]:
+		fmt.Printf("%s%s (already listed)\n", indent, n.name)
+		return
+	}
+	printed[n] = true
+	ancestors[n] = true
+	defer delete(ancestors, n)
+
+	fmt.Printf("%s%s (%d users, %d groups)\n", indent, n.name, len(n.members), len(n.groups))
+	for _, ui := range n.members {
+		fmt.Printf("%s  - %s (%s) %s\n", indent, ui.Account, ui.AccountType, ui.Name)
+	}
+	for _, g := range n.groups {
+		printGroupTree(g, indent+"  ", printed, ancestors)
+	}
+}
@@ -0,0 +1,132 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/spf13/viper"
+	"gopkg.in/ldap.v3"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+func init() {
+	viper.SetDefault("ldap_pool_size", 10)
+	viper.SetDefault("ldap_retries", 3)
+	viper.SetDefault("ldap_backoff", "500ms")
+	viper.SetDefault("ldap_sid_batch", 200)
+}
+
+// ldapPool shares a fixed number of LDAP connections between goroutines.
+// Connections are dialed lazily and re-dialed when they break.
+type ldapPool struct {
+	conns   chan *ldap.Conn
+	retries int
+	backoff time.Duration
+
+	mu       sync.Mutex
+	failures map[string]error // lookup => last error, for lookups that exhausted the retries
+}
+
+func newLDAPPool() *ldapPool {
+	size := viper.GetInt("ldap_pool_size")
+	if size < 1 {
+		size = 1
+	}
+
+	p := &ldapPool{
+		conns:    make(chan *ldap.Conn, size),
+		retries:  viper.GetInt("ldap_retries"),
+		backoff:  viper.GetDuration("ldap_backoff"),
+		failures: map[string]error{},
+	}
+	for i := 0; i < size; i++ {
+		p.conns <- nil
+	}
+	return p
+}
+
+// do runs fn with a connection of the pool. On network or server availability
+// errors the connection is discarded and fn retried with exponential backoff.
+// key identifies the lookup in the failure summary.
+func (p *ldapPool) do(key string, fn func(l *ldap.Conn) error) error {
+	var err error
+	for attempt := 0; attempt <= p.retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(p.backoff * time.Duration(1<<uint(attempt-1)))
+		}
+
+		l := <-p.conns
+		if l == nil || l.IsClosing() {
+			if l, err = dialLDAP(); err != nil {
+				log.Error().Msgf("error connecting to LDAP: attempt:%d err:%+v", attempt, err)
+				p.conns <- nil
+				continue
+			}
+		}
+
+		err = fn(l)
+		if err != nil && isTransientLDAPError(err) {
+			log.Error().Msgf("transient LDAP error: lookup:%s attempt:%d err:%+v", key, attempt, err)
+			l.Close()
+			p.conns <- nil
+			continue
+		}
+
+		p.conns <- l
+		break
+	}
+
+	if err != nil {
+		p.mu.Lock()
+		p.failures[key] = err
+		p.mu.Unlock()
+	}
+	return err
+}
+
+func (p *ldapPool) close() {
+	for i := 0; i < cap(p.conns); i++ {
+		if l := <-p.conns; l != nil {
+			l.Close()
+		}
+	}
+}
+
+// printFailures prints the lookups that failed after all retries.
+func (p *ldapPool) printFailures() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.failures) == 0 {
+		return
+	}
+
+	keys := make([]string, 0, len(p.failures))
+	for k := range p.failures {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	fmt.Fprintf(os.Stderr, "%d LDAP lookups failed, their charge information will be Unknown:\n", len(keys))
+	for _, k := range keys {
+		fmt.Fprintf(os.Stderr, "  %s: %v\n", k, p.failures[k])
+		log.Error().Msgf("LDAP lookup failed: lookup:%s err:%+v", k, p.failures[k])
+	}
+}
+
+func (p *ldapPool) failureCount() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.failures)
+}
+
+func isTransientLDAPError(err error) bool {
+	codes := []uint16{ldap.ErrorNetwork, ldap.LDAPResultBusy, ldap.LDAPResultUnavailable, ldap.LDAPResultServerDown, ldap.LDAPResultTimeLimitExceeded}
+	for _, c := range codes {
+		if ldap.IsErrorWithCode(err, c) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,288 @@
+package cmd
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+func init() {
+	viper.SetDefault("public_link_base_url", "https://cernbox.cern.ch/index.php/s/")
+
+	shareCmd.AddCommand(linksCmd)
+	linksCmd.AddCommand(linksListCmd)
+	linksCmd.AddCommand(linksRevokeCmd)
+	linksCmd.AddCommand(linksExpireCmd)
+	linksCmd.AddCommand(linksRiskCmd)
+
+	linksListCmd.Flags().StringP("owner", "o", "", "filter by owner account")
+	linksListCmd.Flags().Int("older-than", 0, "only links created more than <n> days ago")
+	linksListCmd.Flags().Int("newer-than", 0, "only links created less than <n> days ago")
+	linksListCmd.Flags().String("permission", "", "filter by permission: read-only or read-write")
+	linksListCmd.Flags().String("password", "", "filter by password protection: yes or no")
+	linksListCmd.Flags().String("expiration", "", "filter by expiration date: yes or no")
+	linksListCmd.Flags().BoolP("printpath", "", false, "print EOS path, it can be expensive depending on number of links")
+
+	linksRevokeCmd.Flags().BoolP("yes", "y", false, "revokes the link without confirmation")
+
+	linksExpireCmd.Flags().Bool("clear", false, "removes the expiration date of the link")
+
+	linksRiskCmd.Flags().Int("min-age", 90, "only links created more than <n> days ago")
+	linksRiskCmd.Flags().Int("max-expiration", 30, "links expiring in more than <n> days are also reported")
+	linksRiskCmd.Flags().BoolP("printpath", "", false, "print EOS path, it can be expensive depending on number of links")
+	linksRiskCmd.Flags().String("out", "", "also writes the report into this file")
+}
+
+var linksCmd = &cobra.Command{
+	Use:   "links",
+	Short: "Public links management",
+}
+
+var linksListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "Lists the public links",
+	Run: func(cmd *cobra.Command, args []string) {
+		owner, _ := cmd.Flags().GetString("owner")
+		olderThan, _ := cmd.Flags().GetInt("older-than")
+		newerThan, _ := cmd.Flags().GetInt("newer-than")
+		perm, _ := cmd.Flags().GetString("permission")
+		password, _ := cmd.Flags().GetString("password")
+		expiration, _ := cmd.Flags().GetString("expiration")
+		printpath, _ := cmd.Flags().GetBool("printpath")
+
+		if perm != "" && perm != "read-only" && perm != "read-write" {
+			er("--permission must be read-only or read-write")
+		}
+		hasPassword, err := parseYesNo("password", password)
+		if err != nil {
+			er(err)
+		}
+		hasExpiration, err := parseYesNo("expiration", expiration)
+		if err != nil {
+			er(err)
+		}
+
+		links, err := getPublicLinks(strings.TrimSpace(owner))
+		if err != nil {
+			er(err)
+		}
+
+		now := time.Now()
+		filtered := []*dbShare{}
+		for _, l := range links {
+			age := l.age(now)
+			if olderThan > 0 && age < time.Duration(olderThan)*24*time.Hour {
+				continue
+			}
+			if newerThan > 0 && age >= time.Duration(newerThan)*24*time.Hour {
+				continue
+			}
+			if perm != "" && l.canWrite() != (perm == "read-write") {
+				continue
+			}
+			if hasPassword != nil && l.HasPassword() != *hasPassword {
+				continue
+			}
+			if hasExpiration != nil && l.Expiration.IsZero() == *hasExpiration {
+				continue
+			}
+			filtered = append(filtered, l)
+		}
+
+		cols, rows := linkRows(filtered, printpath)
+		pretty(cols, rows)
+	},
+}
+
+var linksRevokeCmd = &cobra.Command{
+	Use:   "revoke <token>",
+	Short: "Revokes a public link, removing it from the database",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 1 {
+			exit(cmd)
+		}
+
+		link := getPublicLink(strings.TrimSpace(args[0]))
+		cols, rows := linkRows([]*dbShare{link}, false)
+		pretty(cols, rows)
+
+		yes, _ := cmd.Flags().GetBool("yes")
+		if !yes {
+			msg := fmt.Sprintf("Are you sure to revoke the public link of %q?\n", link.UIDOwner)
+			if !askForConfirmation(msg) {
+				fmt.Fprintf(os.Stderr, "Aborted\n")
+				os.Exit(1)
+			}
+		}
+
+		db := getDB()
+		defer db.Close()
+		if err := execShareStmt(db, "delete from oc_share where share_type=3 and token=?", link.Token); err != nil {
+			er(err)
+		}
+		log.Info().Msgf("public link revoked: token:%s owner:%s fileid:%s", link.Token, link.UIDOwner, link.FileID())
+	},
+}
+
+var linksExpireCmd = &cobra.Command{
+	Use:   "expire <token> [YYYY-MM-DD]",
+	Short: "Sets the expiration date of a public link, or clears it with --clear",
+	Run: func(cmd *cobra.Command, args []string) {
+		clear, _ := cmd.Flags().GetBool("clear")
+		if (clear && len(args) != 1) || (!clear && len(args) != 2) {
+			exit(cmd)
+		}
+
+		link := getPublicLink(strings.TrimSpace(args[0]))
+
+		var expiration interface{} // NULL clears the expiration
+		if !clear {
+			t, err := time.ParseInLocation("2006-01-02", strings.TrimSpace(args[1]), time.Local)
+			if err != nil {
+				er(fmt.Sprintf("invalid expiration date %q, expected YYYY-MM-DD", args[1]))
+			}
+			if t.Before(time.Now()) {
+				fmt.Fprintf(os.Stderr, "Warning: the expiration date is in the past, the link is no longer accessible\n")
+			}
+			expiration = t.Format(shareTimeLayout)
+		}
+
+		db := getDB()
+		defer db.Close()
+		if err := execShareStmt(db, "update oc_share set expiration=? where share_type=3 and token=?", expiration, link.Token); err != nil {
+			er(err)
+		}
+		log.Info().Msgf("public link expiration changed: token:%s owner:%s expiration:%v", link.Token, link.UIDOwner, expiration)
+	},
+}
+
+var linksRiskCmd = &cobra.Command{
+	Use:   "risk",
+	Short: "Reports long-lived public links allowing to write without a near expiration date",
+	Run: func(cmd *cobra.Command, args []string) {
+		minAge, _ := cmd.Flags().GetInt("min-age")
+		maxExpiration, _ := cmd.Flags().GetInt("max-expiration")
+		printpath, _ := cmd.Flags().GetBool("printpath")
+		out, _ := cmd.Flags().GetString("out")
+
+		links, err := getPublicLinks("")
+		if err != nil {
+			er(err)
+		}
+
+		now := time.Now()
+		risky := []*dbShare{}
+		for _, l := range links {
+			if isRiskyLink(l, now, minAge, maxExpiration) {
+				risky = append(risky, l)
+			}
+		}
+		// oldest first
+		sort.SliceStable(risky, func(i, j int) bool {
+			return risky[i].STime < risky[j].STime
+		})
+
+		cols, rows := linkRows(risky, printpath)
+		pretty(cols, rows)
+		if out != "" {
+			save(cols, rows, out)
+		}
+		fmt.Fprintf(os.Stderr, "%d of %d public links allow writing, are older than %d days and do not expire in the next %d days\n", len(risky), len(links), minAge, maxExpiration)
+	},
+}
+
+// isRiskyLink tells if l allows writing, including upload-only links, was
+// created more than minAge days ago and does not expire in the next
+// maxExpiration days.
+func isRiskyLink(l *dbShare, now time.Time, minAge, maxExpiration int) bool {
+	if !l.canWrite() {
+		return false
+	}
+	if l.age(now) < time.Duration(minAge)*24*time.Hour {
+		return false
+	}
+	if !l.Expiration.IsZero() && l.Expiration.Before(now.AddDate(0, 0, maxExpiration)) {
+		return false
+	}
+	return true
+}
+
+func linkRows(links []*dbShare, printpath bool) ([]string, [][]string) {
+	cols := []string{"ID", "TOKEN", "OWNER", "FILEID", "PERMISSION", "PASSWORD", "CREATED", "EXPIRATION", "URL"}
+	if printpath {
+		cols = append(cols, "PATH")
+	}
+	rows := [][]string{}
+	for _, l := range links {
+		password := "no"
+		if l.HasPassword() {
+			password = "yes"
+		}
+		row := []string{fmt.Sprintf("%d", l.ID), l.Token, l.UIDOwner, l.FileID(), l.HumanPerm(), password, l.HumanSTime(), l.HumanExpiration(), l.PublicLink()}
+		if printpath {
+			row = append(row, l.GetPath())
+		}
+		rows = append(rows, row)
+	}
+	return cols, rows
+}
+
+// parseYesNo parses a yes/no filter, an empty value means no filter.
+func parseYesNo(name, v string) (*bool, error) {
+	var b bool
+	switch strings.ToLower(strings.TrimSpace(v)) {
+	case "":
+		return nil, nil
+	case "yes", "y", "true":
+		b = true
+	case "no", "n", "false":
+		b = false
+	default:
+		return nil, fmt.Errorf("--%s must be yes or no", name)
+	}
+	return &b, nil
+}
+
+// getPublicLinks returns the public links of owner, or all of them if owner
+// is empty.
+func getPublicLinks(owner string) ([]*dbShare, error) {
+	query := "select " + shareColumns + " from oc_share where share_type=3"
+	args := []interface{}{}
+	if owner != "" {
+		query += " and uid_owner=?"
+		args = append(args, owner)
+	}
+	return getShares(query, args)
+}
+
+// getPublicLink returns the public link of token or exits.
+func getPublicLink(token string) *dbShare {
+	shares, err := getSharesByToken(token)
+	if err != nil {
+		er(err)
+	}
+	for _, s := range shares {
+		if s.ShareType == 3 {
+			return s
+		}
+	}
+	er(fmt.Sprintf("public link %q does not exist", token))
+	return nil
+}
+
+// execShareStmt runs a statement modifying oc_share.
+func execShareStmt(db *sql.DB, query string, args ...interface{}) error {
+	stmt, err := db.Prepare(query)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	_, err = stmt.Exec(args...)
+	return err
+}
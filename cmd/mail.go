@@ -0,0 +1,39 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/spf13/viper"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+func init() {
+	viper.SetDefault("smtp_server", "cernmx.cern.ch:25")
+	viper.SetDefault("mail_from", "cernbox-noreply@cern.ch")
+	viper.SetDefault("mail_domain", "cern.ch")
+}
+
+// sendMail sends a plain text mail through smtp_server.
+var sendMail = func(to []string, subject, body string) error {
+	from := viper.GetString("mail_from")
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	msg.WriteString(strings.Replace(body, "\n", "\r\n", -1))
+
+	return smtp.SendMail(viper.GetString("smtp_server"), nil, from, to, msg.Bytes())
+}
+
+// mailOf returns the mail address of an account, from LDAP if known.
+func mailOf(account string, ui *userInfo) string {
+	if ui != nil && ui.Mail != "" {
+		return ui.Mail
+	}
+	return account + "@" + viper.GetString("mail_domain")
+}
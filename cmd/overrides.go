@@ -0,0 +1,262 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"os"
+	"os/user"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+func init() {
+	viper.SetDefault("charge_overrides_file", "/var/lib/cernboxcop/charge-overrides.json")
+
+	accountingCmd.AddCommand(accountingOverrideCmd)
+	accountingOverrideCmd.AddCommand(accountingOverrideAddCmd)
+	accountingOverrideCmd.AddCommand(accountingOverrideListCmd)
+	accountingOverrideCmd.AddCommand(accountingOverrideRemoveCmd)
+
+	accountingOverrideAddCmd.Flags().StringP("role", "r", "", "charge role to use, by default the one computed for the space")
+	accountingOverrideAddCmd.Flags().String("reason", "", "why the override is needed, e.g. a ticket number (required)")
+	accountingOverrideAddCmd.Flags().String("expires", "", "date (YYYY-MM-DD) after which the override is ignored, by default it never expires")
+
+	accountingOverrideListCmd.Flags().Bool("all", false, "also shows expired overrides")
+}
+
+var accountingOverrideCmd = &cobra.Command{
+	Use:   "override",
+	Short: "Charge group overrides applied on top of the account receiver information",
+}
+
+var accountingOverrideAddCmd = &cobra.Command{
+	Use:   "add <account|space-path> <charge-group>",
+	Short: "Charges an account, or the quota node of a space, to a charge group",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 2 {
+			exit(cmd)
+		}
+
+		target := strings.TrimSpace(args[0])
+		group := strings.TrimSpace(args[1])
+		role, _ := cmd.Flags().GetString("role")
+		reason, _ := cmd.Flags().GetString("reason")
+		expiresStr, _ := cmd.Flags().GetString("expires")
+
+		if target == "" || group == "" {
+			er("account or charge group is empty")
+		}
+		if strings.TrimSpace(reason) == "" {
+			er("--reason is required")
+		}
+
+		o := &chargeOverride{
+			Target:      target,
+			ChargeGroup: group,
+			ChargeRole:  strings.TrimSpace(role),
+			Reason:      strings.TrimSpace(reason),
+			Created:     time.Now(),
+		}
+		if strings.HasPrefix(target, "/") {
+			o.Target = path.Clean(target)
+		}
+		if u, err := user.Current(); err == nil {
+			o.CreatedBy = u.Username
+		}
+		if expiresStr != "" {
+			expires, err := time.ParseInLocation("2006-01-02", expiresStr, time.Local)
+			if err != nil {
+				er(fmt.Sprintf("invalid expiration date %q, expected YYYY-MM-DD", expiresStr))
+			}
+			o.Expires = expires.AddDate(0, 0, 1) // the override is valid during the whole day
+		}
+
+		overrides := loadChargeOverrides()
+		replaced := overrides.remove(o.Target)
+		overrides = append(overrides, o)
+		if err := saveChargeOverrides(overrides); err != nil {
+			er(err)
+		}
+		if replaced {
+			fmt.Printf("Override for %s replaced\n", o.Target)
+		}
+	},
+}
+
+var accountingOverrideListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "Lists the charge group overrides",
+	Run: func(cmd *cobra.Command, args []string) {
+		all, _ := cmd.Flags().GetBool("all")
+
+		cols := []string{"TARGET", "CHARGEGROUP", "CHARGEROLE", "REASON", "CREATED", "CREATEDBY", "EXPIRES"}
+		rows := [][]string{}
+		now := time.Now()
+		for _, o := range loadChargeOverrides() {
+			expired := o.expired(now)
+			if expired && !all {
+				continue
+			}
+			expires := "never"
+			if !o.Expires.IsZero() {
+				expires = o.Expires.AddDate(0, 0, -1).Format("2006-01-02")
+				if expired {
+					expires += " (expired)"
+				}
+			}
+			rows = append(rows, []string{o.Target, o.ChargeGroup, o.ChargeRole, o.Reason, o.Created.Local().Format("2006-01-02"), o.CreatedBy, expires})
+		}
+		pretty(cols, rows)
+	},
+}
+
+var accountingOverrideRemoveCmd = &cobra.Command{
+	Use:   "remove <account|space-path>",
+	Short: "Removes the charge group override of an account or space",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 1 {
+			exit(cmd)
+		}
+
+		target := strings.TrimSpace(args[0])
+		if strings.HasPrefix(target, "/") {
+			target = path.Clean(target)
+		}
+
+		overrides := loadChargeOverrides()
+		if !overrides.remove(target) {
+			er(fmt.Sprintf("no override for %s", target))
+		}
+		if err := saveChargeOverrides(overrides); err != nil {
+			er(err)
+		}
+	},
+}
+
+// chargeOverride charges an account, or a space if Target is a path, to a
+// charge group regardless of what the account receiver says.
+type chargeOverride struct {
+	Target      string
+	ChargeGroup string
+	ChargeRole  string // empty keeps the computed role
+	Reason      string
+	Created     time.Time
+	CreatedBy   string
+	Expires     time.Time // zero never expires
+}
+
+func (o *chargeOverride) expired(now time.Time) bool {
+	return !o.Expires.IsZero() && !now.Before(o.Expires)
+}
+
+type chargeOverrides []*chargeOverride
+
+// remove deletes the override of target and tells if there was one.
+func (overrides *chargeOverrides) remove(target string) bool {
+	kept := chargeOverrides{}
+	for _, o := range *overrides {
+		if o.Target != target {
+			kept = append(kept, o)
+		}
+	}
+	removed := len(kept) != len(*overrides)
+	*overrides = kept
+	return removed
+}
+
+func loadChargeOverrides() chargeOverrides {
+	overrides, err := readChargeOverrides()
+	if err != nil {
+		er(err)
+	}
+	return overrides
+}
+
+// readChargeOverrides reads charge_overrides_file, a missing file has no overrides.
+func readChargeOverrides() (chargeOverrides, error) {
+	overrides := chargeOverrides{}
+	file := viper.GetString("charge_overrides_file")
+	if err := loadJSON(file, &overrides); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("error reading charge overrides %s: %+v", file, err)
+	}
+	return overrides, nil
+}
+
+func saveChargeOverrides(overrides chargeOverrides) error {
+	sort.Slice(overrides, func(i, j int) bool {
+		return overrides[i].Target < overrides[j].Target
+	})
+	return saveJSON(viper.GetString("charge_overrides_file"), overrides)
+}
+
+// applyChargeOverrides replaces the charge information of the spaces matching
+// an override that has not expired. Overrides of a space take precedence over
+// the ones of its account. As a quota node is charged once, under one of its
+// spaces, the override of any space of a node applies to the whole node. If
+// spaces of one node have different overrides, the one of the lowest path is
+// used and the conflict is reported. Overridden spaces keep the reason in
+// chargeInfo.Override so reports can mark them.
+var applyChargeOverrides = func(infos []*projectInfo, overrides chargeOverrides) {
+	now := time.Now()
+	byTarget := map[string]*chargeOverride{}
+	for _, o := range overrides {
+		if !o.expired(now) {
+			byTarget[o.Target] = o
+		}
+	}
+	if len(byTarget) == 0 {
+		return
+	}
+
+	nodes := map[string][]*projectInfo{}
+	keys := []string{}
+	for _, info := range infos {
+		k := quotaNodeKey(info)
+		if _, ok := nodes[k]; !ok {
+			keys = append(keys, k)
+		}
+		nodes[k] = append(nodes[k], info)
+	}
+	sort.Strings(keys)
+
+	applied := 0
+	for _, k := range keys {
+		spaces := nodes[k]
+		sort.SliceStable(spaces, func(i, j int) bool {
+			return spaces[i].FileInfo.File < spaces[j].FileInfo.File
+		})
+
+		var o *chargeOverride
+		for _, info := range spaces {
+			so, ok := byTarget[path.Clean(info.FileInfo.File)]
+			if !ok {
+				continue
+			}
+			if o == nil {
+				o = so
+			} else if so.ChargeGroup != o.ChargeGroup || so.ChargeRole != o.ChargeRole {
+				fmt.Fprintf(os.Stderr, "Warning: %s and %s share a quota node but have different charge overrides, using the one of %s\n", o.Target, so.Target, o.Target)
+				log.Warn().Msgf("conflicting charge overrides in one quota node: node:%s used:%s ignored:%s", k, o.Target, so.Target)
+			}
+		}
+		if o == nil && spaces[0].userInfo.Account != "" {
+			o = byTarget[spaces[0].userInfo.Account]
+		}
+		if o == nil {
+			continue
+		}
+
+		for _, info := range spaces {
+			info.chargeInfo.ChargeGroup = o.ChargeGroup
+			if o.ChargeRole != "" {
+				info.chargeInfo.ChargeRole = o.ChargeRole
+			}
+			info.chargeInfo.Override = o.Reason
+			applied++
+		}
+	}
+	log.Info().Msgf("charge overrides applied: overrides:%d spaces:%d", len(byTarget), applied)
+}
@@ -0,0 +1,78 @@
+package cmd
+
+import (
+	"github.com/rs/zerolog"
+	"testing"
+	"time"
+)
+
+func TestApplyChargeOverrides(t *testing.T) {
+	saved := log
+	nop := zerolog.Nop()
+	log = &nop
+	defer func() { log = saved }()
+
+	tests := []struct {
+		name      string
+		overrides chargeOverrides
+		groups    []string // charge group of every space after applying the overrides
+	}{
+		{
+			name:      "account override charges all its spaces",
+			overrides: chargeOverrides{{Target: "svc", ChargeGroup: "PH"}},
+			groups:    []string{"PH", "PH", "PH", "IT"},
+		},
+		{
+			name:      "space override charges the whole quota node",
+			overrides: chargeOverrides{{Target: "/eos/project/c/beta", ChargeGroup: "PH"}},
+			groups:    []string{"PH", "PH", "IT", "IT"},
+		},
+		{
+			name: "space override takes precedence over the account one",
+			overrides: chargeOverrides{
+				{Target: "svc", ChargeGroup: "EP"},
+				{Target: "/eos/project/c/beta", ChargeGroup: "PH"},
+			},
+			groups: []string{"PH", "PH", "EP", "IT"},
+		},
+		{
+			name: "conflicting overrides in one node use the one of the lowest path",
+			overrides: chargeOverrides{
+				{Target: "/eos/project/c/beta", ChargeGroup: "PH"},
+				{Target: "/eos/project/c/alpha", ChargeGroup: "EP"},
+			},
+			groups: []string{"EP", "EP", "IT", "IT"},
+		},
+		{
+			name:      "expired override is ignored",
+			overrides: chargeOverrides{{Target: "svc", ChargeGroup: "PH", Expires: time.Now().Add(-time.Hour)}},
+			groups:    []string{"IT", "IT", "IT", "IT"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spaces := []*projectInfo{
+				testSpace("svc", "eosproject-c", "/eos/project/c/beta", 10, 100, "IT", "r"),
+				testSpace("svc", "eosproject-c", "/eos/project/c/alpha", 10, 100, "IT", "r"),
+				testSpace("svc", "eosproject-d", "/eos/project/d/data", 10, 100, "IT", "r"),
+				testSpace("jdoe", "eoshome-j", "/eos/user/j/jdoe", 10, 100, "IT", "r"),
+			}
+			applyChargeOverrides(spaces, tt.overrides)
+			for i, s := range spaces {
+				if s.chargeInfo.ChargeGroup != tt.groups[i] {
+					t.Errorf("%s charged to %s, want %s", s.FileInfo.File, s.chargeInfo.ChargeGroup, tt.groups[i])
+				}
+			}
+
+			// the aggregates charge the node to the overridden group whatever path represents it
+			rows := aggregate(spaces, nil, dimChargeGroup)
+			nodes := 0
+			for _, r := range rows {
+				nodes += r.spaces
+			}
+			if nodes != 3 {
+				t.Errorf("aggregate() counted %d quota nodes, want 3", nodes)
+			}
+		})
+	}
+}
@@ -235,8 +235,12 @@ func getProjectOwner(nameOrPath string) (string, error) {
 }
 
 func getProject(nameOrPath string) (*projectSpace, error) {
+	return findProject(getProjectSpaces(""), nameOrPath)
+}
+
+// findProject is getProject on an already loaded list of projects.
+func findProject(projects []*projectSpace, nameOrPath string) (*projectSpace, error) {
 	relpath := getProjectRelPath(nameOrPath)
-	projects := getProjectSpaces("")
 	for i := range projects {
 		if projects[i].rel == relpath {
 			return projects[i], nil
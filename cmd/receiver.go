@@ -0,0 +1,417 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"github.com/mitchellh/mapstructure"
+	"github.com/spf13/viper"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	viper.SetDefault("receiver_url", "https://acc-receiver.cern.ch/v2/fe/"+FE)
+	viper.SetDefault("receiver_dev_url", "https://acc-receiver-dev.cern.ch/v2/fe/"+FE)
+	viper.SetDefault("receiver_charging_url", "https://accounting-receiver.cern.ch/v2/")
+	viper.SetDefault("receiver_timeout", "60s")
+	viper.SetDefault("receiver_retries", 3)
+	viper.SetDefault("receiver_backoff", "2s")
+	viper.SetDefault("receiver_chunk_size", 500)
+	viper.SetDefault("receiver_ledger", "/var/lib/cernboxcop/receiver-ledger.json")
+}
+
+// receiverClient talks to the accounting receiver: records are pushed to
+// pushURL and charge information is read from chargingURL.
+type receiverClient struct {
+	pushURL     string
+	chargingURL string
+	apiKey      string
+	retries     int
+	backoff     time.Duration
+	chunkSize   int
+	ledger      string
+	client      *http.Client
+}
+
+// newReceiverClient returns a client pushing to pushURL, or to receiver_url
+// if empty.
+func newReceiverClient(pushURL string) *receiverClient {
+	if pushURL == "" {
+		pushURL = viper.GetString("receiver_url")
+	}
+	chunkSize := viper.GetInt("receiver_chunk_size")
+	if chunkSize < 1 {
+		chunkSize = 1
+	}
+	return &receiverClient{
+		pushURL:     pushURL,
+		chargingURL: viper.GetString("receiver_charging_url"),
+		apiKey:      viper.GetString("receiver_api_key"),
+		retries:     viper.GetInt("receiver_retries"),
+		backoff:     viper.GetDuration("receiver_backoff"),
+		chunkSize:   chunkSize,
+		ledger:      viper.GetString("receiver_ledger"),
+		client:      &http.Client{Timeout: viper.GetDuration("receiver_timeout")},
+	}
+}
+
+// getReceiverURL returns the push endpoint of the production or the dev receiver.
+func getReceiverURL(dev bool) string {
+	if dev {
+		return viper.GetString("receiver_dev_url")
+	}
+	return viper.GetString("receiver_url")
+}
+
+// receiverStatusError is returned when the receiver answers with an error status.
+type receiverStatusError struct {
+	status int
+	body   string
+}
+
+func (e *receiverStatusError) Error() string {
+	return fmt.Sprintf("accounting receiver returned HTTP %d: %s", e.status, strings.TrimSpace(e.body))
+}
+
+// do sends the request built by newReq and returns the response body. Network
+// errors, 429 and 5xx responses are retried with exponential backoff, other
+// error statuses fail straight away.
+func (c *receiverClient) do(newReq func() (*http.Request, error)) ([]byte, error) {
+	var err error
+	for attempt := 0; attempt <= c.retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(c.backoff * time.Duration(1<<uint(attempt-1)))
+		}
+
+		var req *http.Request
+		if req, err = newReq(); err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if c.apiKey != "" {
+			req.Header.Set("API-Key", c.apiKey)
+		}
+
+		var resp *http.Response
+		if resp, err = c.client.Do(req); err != nil {
+			log.Error().Msgf("error contacting accounting receiver: url:%s attempt:%d err:%+v", req.URL, attempt, err)
+			continue
+		}
+		body, readErr := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if readErr != nil {
+			err = readErr
+			log.Error().Msgf("error reading accounting receiver response: url:%s attempt:%d err:%+v", req.URL, attempt, err)
+			continue
+		}
+
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			return body, nil
+		}
+		err = &receiverStatusError{status: resp.StatusCode, body: string(body)}
+		if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode < 500 {
+			return nil, err
+		}
+		log.Error().Msgf("accounting receiver error: url:%s attempt:%d err:%+v", req.URL, attempt, err)
+	}
+	return nil, err
+}
+
+// push validates records and sends them in chunks of receiver_chunk_size.
+// A payload already pushed for the same date is not sent again unless force
+// is set, so a report can be re-pushed safely. Every chunk sent is recorded
+// in the ledger until the whole payload is, so a push that failed halfway
+// only sends the missing chunks when retried. It returns false if the push
+// was skipped.
+func (c *receiverClient) push(records []*accReceiverJSON, force bool) (bool, error) {
+	if err := validateReceiverRecords(records); err != nil {
+		return false, err
+	}
+	if len(records) == 0 {
+		return false, nil
+	}
+
+	date := records[0].Date
+	hash := receiverPayloadHash(records)
+	ledger := c.loadLedger()
+	key := c.pushURL + " " + date
+	if ledger[key] == hash && !force {
+		log.Info().Msgf("payload already pushed: url:%s date:%s hash:%s", c.pushURL, date, hash)
+		return false, nil
+	}
+
+	// the same payload is always split in the same chunks
+	sorted := append([]*accReceiverJSON{}, records...)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].ChargeGroup != sorted[j].ChargeGroup {
+			return sorted[i].ChargeGroup < sorted[j].ChargeGroup
+		}
+		return sorted[i].ChargeRole < sorted[j].ChargeRole
+	})
+
+	chunkKeys := []string{}
+	for i := 0; i < len(sorted); i += c.chunkSize {
+		end := i + c.chunkSize
+		if end > len(sorted) {
+			end = len(sorted)
+		}
+		chunk := sorted[i:end]
+		chunkKey := fmt.Sprintf("%s %d-%d", key, i+1, end)
+		chunkHash := receiverPayloadHash(chunk)
+		chunkKeys = append(chunkKeys, chunkKey)
+		if ledger[chunkKey] == chunkHash && !force {
+			log.Info().Msgf("chunk already pushed: url:%s date:%s records:%d-%d", c.pushURL, date, i+1, end)
+			continue
+		}
+
+		data, err := json.Marshal(chunk)
+		if err != nil {
+			return false, err
+		}
+		body, err := c.do(func() (*http.Request, error) {
+			return http.NewRequest("POST", c.pushURL, bytes.NewReader(data))
+		})
+		if err != nil {
+			return false, fmt.Errorf("error pushing records %d-%d of %d: %v", i+1, end, len(sorted), err)
+		}
+		log.Info().Msgf("Results from pushing data to receiver service: records:%d-%d %s", i+1, end, string(body))
+
+		ledger[chunkKey] = chunkHash
+		c.saveLedger(ledger)
+	}
+
+	ledger[key] = hash
+	for _, k := range chunkKeys {
+		delete(ledger, k)
+	}
+	c.saveLedger(ledger)
+	return true, nil
+}
+
+// pushFile pushes the records of an accounting-json-accreceiver.json file.
+func (c *receiverClient) pushFile(file string, force bool) (bool, error) {
+	records, err := loadReceiverRecords(file)
+	if err != nil {
+		return false, err
+	}
+	return c.push(records, force)
+}
+
+// saveLedger stores the ledger. Failing to do so is only logged, the data is in
+// the receiver and a later push will just send it again.
+func (c *receiverClient) saveLedger(ledger map[string]string) {
+	if err := saveJSON(c.ledger, ledger); err != nil {
+		log.Error().Msgf("error saving receiver ledger: file:%s err:%+v", c.ledger, err)
+	}
+}
+
+func (c *receiverClient) loadLedger() map[string]string {
+	ledger := map[string]string{}
+	if err := loadJSON(c.ledger, &ledger); err != nil && !os.IsNotExist(err) {
+		log.Error().Msgf("error reading receiver ledger: file:%s err:%+v", c.ledger, err)
+	}
+	return ledger
+}
+
+// charging asks the accounting receiver for the charge information of the
+// given accounts. Accounts unknown to the receiver are not in the result.
+func (c *receiverClient) charging(accounts []string) (map[string]*chargeInfo, error) {
+	data, err := json.Marshal(&chargeJSON{Users: accounts})
+	if err != nil {
+		return nil, err
+	}
+
+	// the API expects the accounts in the body of a GET
+	body, err := c.do(func() (*http.Request, error) {
+		return http.NewRequest("GET", c.chargingURL, bytes.NewReader(data))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	cr := chargeResponse{}
+	if err := json.Unmarshal(body, &cr); err != nil {
+		log.Error().Msgf("error parsing account receiver: %+v", err)
+		return nil, err
+	}
+
+	log.Info().Msgf("Charge info: sent:%d got:%d", len(accounts), len(cr))
+	charges := make(map[string]*chargeInfo, len(cr))
+	for k, v := range cr {
+		ci := &chargeInfo{}
+		if err := mapstructure.Decode(v, ci); err != nil {
+			log.Error().Msgf("error decoding: account:%s value:%s", k, v)
+			continue
+		}
+		// validate input
+		// TODO(labkode): report that the API returns charge type with whitespaces at the beggining.
+		ci.Type = strings.TrimSpace(ci.Type)
+		ci.ChargeGroup = strings.TrimSpace(ci.ChargeGroup)
+		log.Info().Msgf("charge info for account: %s %+v", k, ci)
+		charges[k] = ci
+	}
+	return charges, nil
+}
+
+type chargeJSON struct {
+	Users []string `json:"users"`
+}
+
+type chargeResponse map[string]interface{}
+
+func loadReceiverRecords(file string) ([]*accReceiverJSON, error) {
+	records := []*accReceiverJSON{}
+	if err := loadJSON(file, &records); err != nil {
+		return nil, fmt.Errorf("error reading %s: %v", file, err)
+	}
+	return records, nil
+}
+
+// validateReceiverRecords checks records against the receiver schema. All the
+// records of a push must be for the same date and a charge group and role
+// must appear only once.
+func validateReceiverRecords(records []*accReceiverJSON) error {
+	problems := []string{}
+	seen := map[string]bool{}
+	for i, r := range records {
+		bad := func(format string, args ...interface{}) {
+			problems = append(problems, fmt.Sprintf("record %d (%s/%s): %s", i, r.ChargeGroup, r.ChargeRole, fmt.Sprintf(format, args...)))
+		}
+		if r.MessageFormatVersion != 2 {
+			bad("MessageFormatVersion is %d, must be 2", r.MessageFormatVersion)
+		}
+		if _, err := time.Parse("2006-01-02", r.Date); err != nil {
+			bad("Date %q is not YYYY-MM-DD", r.Date)
+		} else if r.Date != records[0].Date {
+			bad("Date %s differs from %s, push one date at a time", r.Date, records[0].Date)
+		}
+		if r.FE == "" {
+			bad("FE is empty")
+		}
+		if strings.TrimSpace(r.ChargeGroup) == "" {
+			bad("ChargeGroup is empty")
+		}
+		if strings.TrimSpace(r.ChargeRole) == "" {
+			bad("ChargeRole is empty")
+		}
+		if r.DiskUsage < 0 || r.DiskQuota < 0 || r.WallClockHours < 0 || r.CPUHours < 0 {
+			bad("negative DiskUsage, DiskQuota, WallClockHours or CPUHours")
+		}
+		k := r.Date + "\x00" + r.ChargeGroup + "\x00" + r.ChargeRole
+		if seen[k] {
+			bad("duplicated charge group and role")
+		}
+		seen[k] = true
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%d invalid receiver records:\n  %s", len(problems), strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// receiverPayloadHash identifies a payload independently of the order of its records.
+func receiverPayloadHash(records []*accReceiverJSON) string {
+	lines := make([]string, 0, len(records))
+	for _, r := range records {
+		data, _ := json.Marshal(r)
+		lines = append(lines, string(data))
+	}
+	sort.Strings(lines)
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(strings.Join(lines, "\n"))))
+}
+
+// receiverStandIn is a local stand-in for the accounting receiver, to try
+// pushes and charging lookups without touching the real service. Records are
+// kept in memory, pushing again the same date, charge group and role
+// replaces the record as the receiver does.
+type receiverStandIn struct {
+	apiKey  string
+	charges map[string]*chargeInfo
+
+	mu      sync.Mutex
+	records map[string]*accReceiverJSON
+}
+
+func newReceiverStandIn(apiKey string, charges map[string]*chargeInfo) *receiverStandIn {
+	return &receiverStandIn{apiKey: apiKey, charges: charges, records: map[string]*accReceiverJSON{}}
+}
+
+// ServeHTTP serves:
+//
+//	POST /v2/fe/<fe>         push records
+//	GET  /v2/fe/<fe>?date=   list pushed records
+//	GET  /v2/                charge information of {"users": [...]}
+func (s *receiverStandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log.Info().Msgf("receiver stand-in: %s %s", r.Method, r.URL.Path)
+
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/v2/fe/") && r.Method == "POST":
+		if s.apiKey != "" && r.Header.Get("API-Key") != s.apiKey {
+			http.Error(w, "invalid API-Key", http.StatusUnauthorized)
+			return
+		}
+		records := []*accReceiverJSON{}
+		if err := json.NewDecoder(r.Body).Decode(&records); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := validateReceiverRecords(records); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.mu.Lock()
+		for _, rec := range records {
+			s.records[rec.FE+"\x00"+rec.Date+"\x00"+rec.ChargeGroup+"\x00"+rec.ChargeRole] = rec
+		}
+		s.mu.Unlock()
+		fmt.Fprintf(w, `{"accepted": %d}`, len(records))
+
+	case strings.HasPrefix(r.URL.Path, "/v2/fe/") && r.Method == "GET":
+		fe := strings.TrimPrefix(r.URL.Path, "/v2/fe/")
+		date := r.URL.Query().Get("date")
+		records := []*accReceiverJSON{}
+		s.mu.Lock()
+		for _, rec := range s.records {
+			if rec.FE == fe && (date == "" || rec.Date == date) {
+				records = append(records, rec)
+			}
+		}
+		s.mu.Unlock()
+		sort.Slice(records, func(i, j int) bool {
+			a, b := records[i], records[j]
+			if a.Date != b.Date {
+				return a.Date < b.Date
+			}
+			if a.ChargeGroup != b.ChargeGroup {
+				return a.ChargeGroup < b.ChargeGroup
+			}
+			return a.ChargeRole < b.ChargeRole
+		})
+		json.NewEncoder(w).Encode(records)
+
+	case r.URL.Path == "/v2/" && r.Method == "GET":
+		ch := &chargeJSON{}
+		if err := json.NewDecoder(r.Body).Decode(ch); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		res := map[string]*chargeInfo{}
+		for _, u := range ch.Users {
+			if ci, ok := s.charges[u]; ok {
+				res[u] = ci
+			}
+		}
+		json.NewEncoder(w).Encode(res)
+
+	default:
+		http.NotFound(w, r)
+	}
+}
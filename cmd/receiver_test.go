@@ -0,0 +1,208 @@
+package cmd
+
+import (
+	"encoding/json"
+	"github.com/rs/zerolog"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestReceiver returns a client of a receiver served by h, pushing one
+// record per chunk, and a function to stop the receiver when done.
+func newTestReceiver(t *testing.T, h http.Handler) (*receiverClient, *httptest.Server, func()) {
+	saved := log
+	nop := zerolog.Nop()
+	log = &nop
+
+	dir, err := ioutil.TempDir("", "receiver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(h)
+	c := &receiverClient{
+		pushURL:     srv.URL + "/v2/fe/" + FE,
+		chargingURL: srv.URL + "/v2/",
+		apiKey:      "secret",
+		backoff:     time.Millisecond,
+		chunkSize:   1,
+		ledger:      filepath.Join(dir, "ledger.json"),
+		client:      srv.Client(),
+	}
+	return c, srv, func() {
+		srv.Close()
+		os.RemoveAll(dir)
+		log = saved
+	}
+}
+
+func testReceiverRecords(date string, usage ...int) []*accReceiverJSON {
+	records := []*accReceiverJSON{}
+	for i, u := range usage {
+		records = append(records, &accReceiverJSON{
+			DiskUsage:            u,
+			DiskQuota:            u * 2,
+			Date:                 date,
+			MessageFormatVersion: 2,
+			ChargeGroup:          "IT",
+			ChargeRole:           []string{"CERNBox Home Directories", "CERNBox Project Spaces"}[i],
+			FE:                   FE,
+		})
+	}
+	return records
+}
+
+// pushedRecords lists the records the stand-in holds for date.
+func pushedRecords(t *testing.T, srv *httptest.Server, date string) []*accReceiverJSON {
+	resp, err := srv.Client().Get(srv.URL + "/v2/fe/" + FE + "?date=" + date)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	records := []*accReceiverJSON{}
+	if err := json.NewDecoder(resp.Body).Decode(&records); err != nil {
+		t.Fatal(err)
+	}
+	return records
+}
+
+func TestReceiverPush(t *testing.T) {
+	c, srv, done := newTestReceiver(t, newReceiverStandIn("secret", nil))
+	defer done()
+
+	tests := []struct {
+		name    string
+		records []*accReceiverJSON
+		force   bool
+		pushed  bool
+		usage   []int // usage held by the receiver after the push
+	}{
+		{"first push", testReceiverRecords("2026-09-30", 10, 20), false, true, []int{10, 20}},
+		{"same payload is skipped", testReceiverRecords("2026-09-30", 10, 20), false, false, []int{10, 20}},
+		{"same payload is sent with force", testReceiverRecords("2026-09-30", 10, 20), true, true, []int{10, 20}},
+		{"changed payload replaces the records", testReceiverRecords("2026-09-30", 11, 21), false, true, []int{11, 21}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pushed, err := c.push(tt.records, tt.force)
+			if err != nil {
+				t.Fatalf("push() error: %v", err)
+			}
+			if pushed != tt.pushed {
+				t.Errorf("push() = %v, want %v", pushed, tt.pushed)
+			}
+			got := []int{}
+			for _, r := range pushedRecords(t, srv, "2026-09-30") {
+				got = append(got, r.DiskUsage)
+			}
+			if len(got) != len(tt.usage) || got[0] != tt.usage[0] || got[1] != tt.usage[1] {
+				t.Errorf("receiver holds usage %v, want %v", got, tt.usage)
+			}
+		})
+	}
+}
+
+func TestReceiverPushErrors(t *testing.T) {
+	c, srv, done := newTestReceiver(t, newReceiverStandIn("secret", nil))
+	defer done()
+
+	invalid := testReceiverRecords("2026-09-30", 10, 20)
+	invalid[1].Date = "2026-10-01"
+	if _, err := c.push(invalid, false); err == nil {
+		t.Error("push() of records of two dates succeeded, want a validation error")
+	}
+
+	c.apiKey = "wrong"
+	if _, err := c.push(testReceiverRecords("2026-09-30", 10, 20), false); err == nil {
+		t.Error("push() with a wrong API key succeeded, want an error")
+	}
+	if got := pushedRecords(t, srv, "2026-09-30"); len(got) != 0 {
+		t.Errorf("receiver holds %d records after failed pushes, want 0", len(got))
+	}
+
+	// a failed push is not recorded in the ledger, so it is sent again
+	c.apiKey = "secret"
+	if pushed, err := c.push(testReceiverRecords("2026-09-30", 10, 20), false); err != nil || !pushed {
+		t.Errorf("push() after failures = %v, %v, want true, nil", pushed, err)
+	}
+}
+
+func TestReceiverPushResume(t *testing.T) {
+	standIn := newReceiverStandIn("secret", nil)
+	posts, failAt := 0, 2
+	c, srv, done := newTestReceiver(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			posts++
+			if posts == failAt {
+				http.Error(w, "unavailable", http.StatusServiceUnavailable)
+				return
+			}
+		}
+		standIn.ServeHTTP(w, r)
+	}))
+	defer done()
+
+	records := testReceiverRecords("2026-09-30", 10, 20)
+	if _, err := c.push(records, false); err == nil {
+		t.Fatal("push() with a failing second chunk succeeded, want an error")
+	}
+	if got := pushedRecords(t, srv, "2026-09-30"); len(got) != 1 {
+		t.Fatalf("receiver holds %d records after a failed chunk, want 1", len(got))
+	}
+
+	// the retry only sends the chunk that failed
+	posts = 0
+	if pushed, err := c.push(records, false); err != nil || !pushed {
+		t.Fatalf("push() after a failed chunk = %v, %v, want true, nil", pushed, err)
+	}
+	if posts != 1 {
+		t.Errorf("push() after a failed chunk sent %d chunks, want 1", posts)
+	}
+	if got := pushedRecords(t, srv, "2026-09-30"); len(got) != 2 {
+		t.Errorf("receiver holds %d records, want 2", len(got))
+	}
+
+	// once complete, only the payload is in the ledger
+	if ledger := c.loadLedger(); len(ledger) != 1 {
+		t.Errorf("ledger has %d entries after a complete push, want 1: %v", len(ledger), ledger)
+	}
+}
+
+func TestReceiverCharging(t *testing.T) {
+	charges := map[string]*chargeInfo{
+		"jdoe":   {Type: "user", ChargeGroup: "IT", ChargeRole: "Primary-Account"},
+		"cbxsvc": {Type: "service", ChargeGroup: "EP", ChargeRole: "Service-Account"},
+	}
+	c, _, done := newTestReceiver(t, newReceiverStandIn("secret", charges))
+	defer done()
+
+	got, err := c.charging([]string{"jdoe", "cbxsvc", "unknown"})
+	if err != nil {
+		t.Fatalf("charging() error: %v", err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("charging() returned %d accounts, want 2", len(got))
+	}
+	for account, want := range charges {
+		if ci := got[account]; ci == nil || ci.ChargeGroup != want.ChargeGroup || ci.ChargeRole != want.ChargeRole {
+			t.Errorf("charging()[%s] = %+v, want %+v", account, ci, want)
+		}
+	}
+}
+
+func TestReceiverStandInNotFound(t *testing.T) {
+	_, srv, done := newTestReceiver(t, newReceiverStandIn("secret", nil))
+	defer done()
+	resp, err := srv.Client().Get(srv.URL + "/v1/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("GET /v1/ = %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+}
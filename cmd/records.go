@@ -0,0 +1,75 @@
+package cmd
+
+import (
+	"encoding/json"
+	"github.com/cs3org/reva/pkg/eosclient"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+)
+
+// infoRecord is the serializable form of a projectInfo, used to store
+// accounting data between runs.
+type infoRecord struct {
+	Created  time.Time
+	FileInfo *eosclient.FileInfo
+	User     *cachedUserInfo
+	Quota    *eosclient.QuotaInfo
+	Charge   chargeInfo
+}
+
+func newInfoRecords(infos []*projectInfo) []*infoRecord {
+	records := make([]*infoRecord, 0, len(infos))
+	for _, p := range infos {
+		records = append(records, &infoRecord{
+			Created:  p.created,
+			FileInfo: p.FileInfo,
+			User:     newCachedUserInfo(p.userInfo),
+			Quota:    p.QuotaInfo,
+			Charge:   p.chargeInfo,
+		})
+	}
+	return records
+}
+
+func projectInfosFromRecords(records []*infoRecord) []*projectInfo {
+	infos := make([]*projectInfo, 0, len(records))
+	for _, r := range records {
+		quota := r.Quota
+		if quota == nil {
+			quota = &eosclient.QuotaInfo{}
+		}
+		infos = append(infos, &projectInfo{
+			created:    r.Created,
+			FileInfo:   r.FileInfo,
+			userInfo:   r.User.userInfo(),
+			QuotaInfo:  quota,
+			chargeInfo: r.Charge,
+		})
+	}
+	return infos
+}
+
+// saveJSON atomically replaces file with the JSON encoding of v.
+func saveJSON(file string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	os.MkdirAll(path.Dir(file), 0755)
+	tmp := file + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+func loadJSON(file string, v interface{}) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
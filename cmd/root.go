@@ -3,6 +3,7 @@ package cmd
 import (
 	"bufio"
 	"context"
+	"crypto/tls"
 	"database/sql"
 	"fmt"
 	"github.com/cs3org/reva/pkg/appctx"
@@ -107,15 +108,40 @@ func getRedis() *redis.Client {
 }
 
 func getLDAP() *ldap.Conn {
-	host := viper.GetString("ldap_host")
-	port := viper.GetInt("ldap_port")
-	l, err := ldap.Dial("tcp", fmt.Sprintf("%s:%d", host, port))
+	l, err := dialLDAP()
 	if err != nil {
 		er(err)
 	}
 	return l
 }
 
+// dialLDAP connects to LDAP, using LDAPS if ldap_tls is set, and binds
+// with ldap_bind_dn and ldap_bind_password when configured.
+func dialLDAP() (*ldap.Conn, error) {
+	host := viper.GetString("ldap_host")
+	port := viper.GetInt("ldap_port")
+	addr := fmt.Sprintf("%s:%d", host, port)
+
+	var l *ldap.Conn
+	var err error
+	if viper.GetBool("ldap_tls") {
+		l, err = ldap.DialTLS("tcp", addr, &tls.Config{ServerName: host, InsecureSkipVerify: viper.GetBool("ldap_insecure")})
+	} else {
+		l, err = ldap.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if bindDN := viper.GetString("ldap_bind_dn"); bindDN != "" {
+		if err := l.Bind(bindDN, viper.GetString("ldap_bind_password")); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
 func getEOS(mgm string) *eosclient.Client {
 	eosClientOpts := &eosclient.Options{
 		URL: mgm,
@@ -126,9 +152,7 @@ func getEOS(mgm string) *eosclient.Client {
 }
 
 func getEOSForUser(username string) *eosclient.Client {
-	letter := string(username[0])
-	mgm := fmt.Sprintf("root://eoshome-%s.cern.ch", letter)
-	return getEOS(mgm)
+	return getEOS(getTopology().homeMGM(username))
 }
 
 func saveWith(file string, data []byte) {
@@ -0,0 +1,316 @@
+package cmd
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+func init() {
+	// maximum age in days per share type, a missing or 0 entry never expires
+	viper.SetDefault("share_max_age", map[string]int{"public-link": 365})
+	viper.SetDefault("share_notice_days", 30)
+	viper.SetDefault("share_policy_state", "/var/lib/cernboxcop/share-policy.json")
+
+	shareCmd.AddCommand(sharePolicyCmd)
+	sharePolicyCmd.AddCommand(sharePolicyRunCmd)
+	sharePolicyCmd.AddCommand(sharePolicyStatusCmd)
+
+	sharePolicyRunCmd.Flags().Bool("remove", false, "removes the marked shares whose notice period is over. Without it they are only reported")
+	sharePolicyRunCmd.Flags().Bool("no-mail", false, "marks shares without notifying their owners")
+	sharePolicyRunCmd.Flags().Bool("dry-run", false, "shows what would be done without marking, notifying or removing anything")
+	sharePolicyRunCmd.Flags().String("out", "", "also writes the report into this file")
+}
+
+var sharePolicyCmd = &cobra.Command{
+	Use:   "policy",
+	Short: "Expiration policy of shares, configured with share_max_age (days per share type) and share_notice_days",
+}
+
+var sharePolicyRunCmd = &cobra.Command{
+	Use:   "run",
+	Short: "Marks the shares exceeding their maximum age, notifies their owners and removes them after the notice period",
+	Run: func(cmd *cobra.Command, args []string) {
+		remove, _ := cmd.Flags().GetBool("remove")
+		noMail, _ := cmd.Flags().GetBool("no-mail")
+		dryRun, _ := cmd.Flags().GetBool("dry-run")
+		out, _ := cmd.Flags().GetString("out")
+
+		policy := loadSharePolicy()
+		if len(policy.maxAge) == 0 {
+			er("share_max_age does not set a maximum age for any share type")
+		}
+
+		shares, err := getAllShares()
+		if err != nil {
+			er(err)
+		}
+
+		state := loadSharePolicyState()
+		actions := policy.evaluate(shares, state, !noMail, time.Now())
+
+		if !dryRun {
+			if !noMail {
+				notifyShareOwners(actions, policy.notice)
+			}
+			if remove {
+				db := getDB()
+				defer db.Close()
+				removeExpiredShares(db, actions)
+			}
+			state.update(actions)
+			if err := saveJSON(viper.GetString("share_policy_state"), state); err != nil {
+				er(err)
+			}
+		}
+
+		cols, rows := sharePolicyRows(actions)
+		pretty(cols, rows)
+		if out != "" {
+			save(cols, rows, out)
+		}
+	},
+}
+
+var sharePolicyStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Lists the shares marked for removal",
+	Run: func(cmd *cobra.Command, args []string) {
+		state := loadSharePolicyState()
+		marks := make([]*shareMark, 0, len(state.Marks))
+		for _, m := range state.Marks {
+			marks = append(marks, m)
+		}
+		sort.Slice(marks, func(i, j int) bool {
+			return marks[i].RemoveAfter.Before(marks[j].RemoveAfter)
+		})
+
+		cols := []string{"ID", "OWNER", "TYPE", "MARKED", "NOTIFIED", "REMOVEAFTER"}
+		rows := [][]string{}
+		for _, m := range marks {
+			notified := "no"
+			if !m.Notified.IsZero() {
+				notified = m.Notified.Local().Format("2006-01-02")
+			}
+			rows = append(rows, []string{fmt.Sprintf("%d", m.ID), m.Owner, m.Type, m.Marked.Local().Format("2006-01-02"), notified, m.RemoveAfter.Local().Format("2006-01-02")})
+		}
+		pretty(cols, rows)
+	},
+}
+
+type sharePolicy struct {
+	maxAge map[string]time.Duration // share type => maximum age
+	notice time.Duration
+}
+
+func loadSharePolicy() *sharePolicy {
+	p := &sharePolicy{
+		maxAge: map[string]time.Duration{},
+		notice: time.Duration(viper.GetInt("share_notice_days")) * 24 * time.Hour,
+	}
+	for t, days := range viper.GetStringMap("share_max_age") {
+		if !isShareType(t) {
+			er(fmt.Sprintf("share_max_age: unknown share type %q", t))
+		}
+		if d := time.Duration(toInt(days)) * 24 * time.Hour; d > 0 {
+			p.maxAge[t] = d
+		}
+	}
+	return p
+}
+
+func toInt(v interface{}) int {
+	switch n := v.(type) {
+	case int:
+		return n
+	case int64:
+		return int(n)
+	case float64:
+		return int(n)
+	}
+	er(fmt.Sprintf("share_max_age: %v is not a number of days", v))
+	return 0
+}
+
+// sharePolicyState keeps the shares marked for removal between runs.
+type sharePolicyState struct {
+	Marks map[int]*shareMark // share id => mark
+}
+
+// shareMark is a share exceeding its maximum age. It is removed once
+// RemoveAfter is reached, which leaves the owner the notice period to act.
+type shareMark struct {
+	ID          int
+	Owner       string
+	Type        string
+	FileID      string
+	Marked      time.Time
+	Notified    time.Time // zero if the owner was not notified
+	RemoveAfter time.Time
+}
+
+func loadSharePolicyState() *sharePolicyState {
+	state := &sharePolicyState{Marks: map[int]*shareMark{}}
+	file := viper.GetString("share_policy_state")
+	if err := loadJSON(file, state); err != nil && !os.IsNotExist(err) {
+		er(fmt.Sprintf("error reading share policy state %s: %+v", file, err))
+	}
+	if state.Marks == nil {
+		state.Marks = map[int]*shareMark{}
+	}
+	return state
+}
+
+// Actions of a policy run.
+const (
+	sharePolicyMark    = "mark"    // newly exceeding or owner not notified yet, the owner is notified
+	sharePolicyPending = "pending" // marked, still in the notice period
+	sharePolicyDue     = "due"     // marked and notice period over
+	sharePolicyRemoved = "removed"
+	sharePolicyFailed  = "failed"
+)
+
+type sharePolicyAction struct {
+	share  *dbShare
+	mark   *shareMark
+	action string
+	err    error
+}
+
+// evaluate decides what to do with every share exceeding its maximum age.
+// If notify is set, shares are only due once their owner has been notified.
+// Marks of shares that no longer exist are dropped by update.
+func (p *sharePolicy) evaluate(shares []*dbShare, state *sharePolicyState, notify bool, now time.Time) []*sharePolicyAction {
+	actions := []*sharePolicyAction{}
+	for _, s := range shares {
+		maxAge, ok := p.maxAge[s.HumanType()]
+		if !ok || s.age(now) <= maxAge {
+			continue
+		}
+
+		a := &sharePolicyAction{share: s}
+		if m, ok := state.Marks[s.ID]; ok {
+			a.mark = m
+			switch {
+			case notify && m.Notified.IsZero():
+				a.action = sharePolicyMark
+			case now.Before(m.RemoveAfter):
+				a.action = sharePolicyPending
+			default:
+				a.action = sharePolicyDue
+			}
+		} else {
+			a.mark = &shareMark{ID: s.ID, Owner: s.UIDOwner, Type: s.HumanType(), FileID: s.FileID(), Marked: now, RemoveAfter: now.Add(p.notice)}
+			a.action = sharePolicyMark
+		}
+		actions = append(actions, a)
+	}
+
+	sort.Slice(actions, func(i, j int) bool {
+		if actions[i].share.UIDOwner != actions[j].share.UIDOwner {
+			return actions[i].share.UIDOwner < actions[j].share.UIDOwner
+		}
+		return actions[i].share.ID < actions[j].share.ID
+	})
+	return actions
+}
+
+// update keeps the marks of the shares still exceeding their maximum age and
+// not removed.
+func (state *sharePolicyState) update(actions []*sharePolicyAction) {
+	marks := map[int]*shareMark{}
+	for _, a := range actions {
+		if a.action != sharePolicyRemoved {
+			marks[a.mark.ID] = a.mark
+		}
+	}
+	state.Marks = marks
+}
+
+// notifyShareOwners sends one mail per owner listing their newly marked
+// shares and when they will be removed. The notice period starts when the
+// mail is sent.
+func notifyShareOwners(actions []*sharePolicyAction, notice time.Duration) {
+	byOwner := map[string][]*sharePolicyAction{}
+	for _, a := range actions {
+		if a.action == sharePolicyMark {
+			byOwner[a.share.UIDOwner] = append(byOwner[a.share.UIDOwner], a)
+		}
+	}
+	if len(byOwner) == 0 {
+		return
+	}
+
+	owners := make([]string, 0, len(byOwner))
+	for o := range byOwner {
+		owners = append(owners, o)
+	}
+	infos := getAccountsInfo(owners, 20)
+
+	now := time.Now()
+	for owner, marked := range byOwner {
+		for _, a := range marked {
+			a.mark.RemoveAfter = now.Add(notice)
+		}
+		to := mailOf(owner, infos[owner])
+		if err := sendMail([]string{to}, "Your CERNBox shares are about to expire", shareNoticeBody(owner, marked)); err != nil {
+			log.Error().Msgf("error notifying share owner: owner:%s mail:%s err:%+v", owner, to, err)
+			fmt.Fprintf(os.Stderr, "Error notifying %s <%s>: %v\n", owner, to, err)
+			continue
+		}
+		for _, a := range marked {
+			a.mark.Notified = now
+		}
+		log.Info().Msgf("share owner notified: owner:%s mail:%s shares:%d", owner, to, len(marked))
+	}
+}
+
+func shareNoticeBody(owner string, marked []*sharePolicyAction) string {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "Dear %s,\n\n", owner)
+	fmt.Fprintf(&b, "The following CERNBox shares exceed the maximum age allowed for their type and will be removed:\n\n")
+	for _, a := range marked {
+		target := a.share.HumanShareWith()
+		if a.share.ShareType == 3 {
+			target = a.share.PublicLink()
+		}
+		fmt.Fprintf(&b, "  - %s %s (%s), created on %s, removed after %s\n", a.share.HumanType(), target, a.share.HumanPerm(), a.share.HumanSTime(), a.mark.RemoveAfter.Local().Format("2006-01-02"))
+	}
+	fmt.Fprintf(&b, "\nIf you still need them, please create them again from the CERNBox web interface.\n\nThe CERNBox team\n")
+	return b.String()
+}
+
+// removeExpiredShares removes the shares whose notice period is over.
+func removeExpiredShares(db *sql.DB, actions []*sharePolicyAction) {
+	for _, a := range actions {
+		if a.action != sharePolicyDue {
+			continue
+		}
+		if err := execShareStmt(db, "delete from oc_share where id=?", a.share.ID); err != nil {
+			log.Error().Msgf("error removing expired share: id:%d err:%+v", a.share.ID, err)
+			a.action, a.err = sharePolicyFailed, err
+			continue
+		}
+		a.action = sharePolicyRemoved
+		log.Info().Msgf("expired share removed: id:%d owner:%s type:%s fileid:%s", a.share.ID, a.share.UIDOwner, a.share.HumanType(), a.share.FileID())
+	}
+}
+
+func sharePolicyRows(actions []*sharePolicyAction) ([]string, [][]string) {
+	cols := []string{"ID", "OWNER", "TYPE", "SHARE_WITH", "CREATED", "ACTION", "REMOVEAFTER", "ERROR"}
+	rows := [][]string{}
+	for _, a := range actions {
+		errMsg := ""
+		if a.err != nil {
+			errMsg = strings.Replace(a.err.Error(), "\n", " ", -1)
+		}
+		rows = append(rows, []string{fmt.Sprintf("%d", a.share.ID), a.share.UIDOwner, a.share.HumanType(), a.share.HumanShareWith(), a.share.HumanSTime(), a.action, a.mark.RemoveAfter.Local().Format("2006-01-02"), errMsg})
+	}
+	return cols, rows
+}
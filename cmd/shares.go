@@ -4,9 +4,11 @@ import (
 	"context"
 	"fmt"
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 )
 
 func init() {
@@ -70,7 +72,7 @@ var shareTransferCmd = &cobra.Command{
 
 		// check share points to a project
 		if !strings.Contains(share.Prefix, "project") {
-			fmt.Fprintf(os.Stderr, "Error: the share does not point to file/folder inside an EOS project. Only shared on projects can be transfered\n")
+			fmt.Fprintf(os.Stderr, "Error: the share does not point to file/folder inside an EOS project. Only shared on projects can be transfered, use transfer-user to move the shares of a departed user\n")
 			os.Exit(1)
 		}
 
@@ -82,18 +84,8 @@ var shareTransferCmd = &cobra.Command{
 		}
 		// Only admins can create shares on project spaces.
 		// Check that the new owner is also in the admin e-group.
-		adminGroup := fmt.Sprintf("cernbox-project-%s-admins", projectInfo.name)
-		groups := getUserGroups(owner)
-		var found bool
-		for _, g := range groups {
-			if adminGroup == g {
-				found = true
-				break
-			}
-		}
-
-		if !found {
-			fmt.Fprintf(os.Stderr, "Error: the new owner does not belong to the admin group %q. Only admins can manage shares. Ask the user to join the admin group.\n", adminGroup)
+		if !isProjectAdmin(owner, projectInfo) {
+			fmt.Fprintf(os.Stderr, "Error: the new owner does not belong to the admin group %q. Only admins can manage shares. Ask the user to join the admin group.\n", projectAdminGroup(projectInfo))
 			os.Exit(1)
 		}
 
@@ -184,6 +176,21 @@ var shareListCmd = &cobra.Command{
 	},
 }
 
+func projectAdminGroup(project *projectSpace) string {
+	return fmt.Sprintf("cernbox-project-%s-admins", project.name)
+}
+
+// isProjectAdmin tells if account is in the admin e-group of project.
+func isProjectAdmin(account string, project *projectSpace) bool {
+	adminGroup := projectAdminGroup(project)
+	for _, g := range getUserGroups(account) {
+		if adminGroup == g {
+			return true
+		}
+	}
+	return false
+}
+
 type dbShare struct {
 	ID          int
 	UIDOwner    string
@@ -196,21 +203,36 @@ type dbShare struct {
 	FileTarget  string
 	State       int
 	Token       string
+	Expiration  time.Time // zero if the share does not expire
 }
 
+// shareTimeLayout is the layout of the oc_share datetime columns.
+const shareTimeLayout = "2006-01-02 15:04:05"
+
+// Bits of the oc_share permissions column.
+const (
+	sharePermRead   = 1
+	sharePermUpdate = 2
+	sharePermCreate = 4
+	sharePermDelete = 8
+	sharePermShare  = 16
+)
+
 func (s *dbShare) FileID() string {
-	v := fmt.Sprintf("%s:%s", s.Prefix, s.ItemSource)
 	// replace internal namespacing for one user friendly.
-	// newproject-c => eosproject-c
-	v = strings.ReplaceAll(v, "new", "eos")
-	return v
+	return fmt.Sprintf("%s:%s", getTopology().prefixName(s.Prefix), s.ItemSource)
 }
 
 func (s *dbShare) PublicLink() string {
 	if s.ShareType != 3 {
 		return "-"
 	}
-	return fmt.Sprintf("https://cernbox.cern.ch/index.php/s/%s", s.Token)
+	return strings.TrimRight(viper.GetString("public_link_base_url"), "/") + "/" + s.Token
+}
+
+// canWrite tells if the share allows to modify, upload or delete files.
+func (s *dbShare) canWrite() bool {
+	return s.Permissions&(sharePermUpdate|sharePermCreate|sharePermDelete) != 0
 }
 
 func (s *dbShare) HumanShareWith() string {
@@ -220,11 +242,33 @@ func (s *dbShare) HumanShareWith() string {
 	return s.ShareWith
 }
 
+// HasPassword tells if a public link is protected by a password, whose hash
+// is stored in share_with.
+func (s *dbShare) HasPassword() bool {
+	return s.ShareType == 3 && s.ShareWith != ""
+}
+
+func (s *dbShare) HumanSTime() string {
+	return time.Unix(int64(s.STime), 0).Format("2006-01-02")
+}
+
+func (s *dbShare) HumanExpiration() string {
+	if s.Expiration.IsZero() {
+		return "never"
+	}
+	return s.Expiration.Format("2006-01-02")
+}
+
+func (s *dbShare) age(now time.Time) time.Duration {
+	return now.Sub(time.Unix(int64(s.STime), 0))
+}
+
+// HumanPerm is read-write if the share allows writing, see canWrite, or read-only.
 func (s *dbShare) HumanPerm() string {
-	if s.Permissions == 1 {
-		return "read-only"
+	if s.canWrite() {
+		return "read-write"
 	}
-	return "read-write"
+	return "read-only"
 }
 
 func (s *dbShare) HumanType() string {
@@ -243,12 +287,11 @@ func (s *dbShare) HumanType() string {
 func (s *dbShare) GetPath() string {
 	inode, err := strconv.ParseUint(s.ItemSource, 10, 64)
 	if err != nil {
-		er(err)
+		log.Error().Msgf("invalid share item_source: id:%d item_source:%q", s.ID, s.ItemSource)
+		return "-"
 	}
 
-	mgm := fmt.Sprintf("root://%s.cern.ch", s.Prefix)
-	mgm = strings.ReplaceAll(mgm, "new", "eos")
-	client := getEOS(mgm)
+	client := getEOS(getTopology().prefixMGM(s.Prefix))
 	ctx := context.Background()
 	fi, err := client.GetFileInfoByInode(ctx, "root", inode)
 	if err != nil {
@@ -257,36 +300,39 @@ func (s *dbShare) GetPath() string {
 	return fi.File
 }
 
+// shareColumns are the oc_share columns scanned by getShares.
+const shareColumns = "id, coalesce(uid_owner, '') as uid_owner,  coalesce(share_with, '') as share_with, coalesce(fileid_prefix, '') as fileid_prefix, coalesce(item_source, '') as item_source, stime, permissions, share_type, coalesce(token, '') as token, coalesce(expiration, '') as expiration"
+
 func getSharesByToken(token string) (shares []*dbShare, err error) {
-	query := "select id, coalesce(uid_owner, '') as uid_owner,  coalesce(share_with, '') as share_with, coalesce(fileid_prefix, '') as fileid_prefix, coalesce(item_source, '') as item_source, stime, permissions, share_type, coalesce(token, '') as token from oc_share where token=?"
+	query := "select " + shareColumns + " from oc_share where token=?"
 	args := []interface{}{token}
 
 	return getShares(query, args)
 }
 
 func getSharesByWith(with string) (shares []*dbShare, err error) {
-	query := "select id, coalesce(uid_owner, '') as uid_owner,  coalesce(share_with, '') as share_with, coalesce(fileid_prefix, '') as fileid_prefix, coalesce(item_source, '') as item_source, stime, permissions, share_type, coalesce(token, '') as token from oc_share where share_with=?"
+	query := "select " + shareColumns + " from oc_share where share_with=?"
 	args := []interface{}{with}
 
 	return getShares(query, args)
 }
 
 func getSharesByID(id string) (shares []*dbShare, err error) {
-	query := "select id, coalesce(uid_owner, '') as uid_owner,  coalesce(share_with, '') as share_with, coalesce(fileid_prefix, '') as fileid_prefix, coalesce(item_source, '') as item_source, stime, permissions, share_type, coalesce(token, '') as token from oc_share where id=?"
+	query := "select " + shareColumns + " from oc_share where id=?"
 	args := []interface{}{id}
 
 	return getShares(query, args)
 }
 
 func getSharesByOwner(owner string) (shares []*dbShare, err error) {
-	query := "select id, coalesce(uid_owner, '') as uid_owner,  coalesce(share_with, '') as share_with, coalesce(fileid_prefix, '') as fileid_prefix, coalesce(item_source, '') as item_source, stime, permissions, share_type, coalesce(token, '') as token from oc_share where uid_owner=?"
+	query := "select " + shareColumns + " from oc_share where uid_owner=?"
 	args := []interface{}{owner}
 
 	return getShares(query, args)
 }
 
 func getAllShares() (shares []*dbShare, err error) {
-	query := "select id, coalesce(uid_owner, '') as uid_owner,  coalesce(share_with, '') as share_with, coalesce(fileid_prefix, '') as fileid_prefix, coalesce(item_source, '') as item_source, stime, permissions, share_type, coalesce(token, '') as token from oc_share"
+	query := "select " + shareColumns + " from oc_share"
 	return getShares(query, nil)
 }
 
@@ -303,6 +349,7 @@ func getShares(query string, args []interface{}) (shares []*dbShare, err error)
 		stime       int
 		permissions int
 		token       string
+		expiration  string
 	)
 
 	rows, err := db.Query(query, args...)
@@ -312,11 +359,19 @@ func getShares(query string, args []interface{}) (shares []*dbShare, err error)
 	defer rows.Close()
 
 	for rows.Next() {
-		err := rows.Scan(&id, &uidOwner, &shareWith, &prefix, &itemSource, &stime, &permissions, &shareType, &token)
+		err := rows.Scan(&id, &uidOwner, &shareWith, &prefix, &itemSource, &stime, &permissions, &shareType, &token, &expiration)
 		if err != nil {
 			return nil, err
 		}
 		dbShare := &dbShare{ID: id, UIDOwner: uidOwner, Prefix: prefix, ItemSource: itemSource, ShareWith: shareWith, STime: stime, Permissions: permissions, ShareType: shareType, Token: token}
+		// zero and malformed dates are taken as no expiration
+		if expiration != "" && !strings.HasPrefix(expiration, "0000-00-00") {
+			if t, err := time.ParseInLocation(shareTimeLayout, expiration, time.Local); err == nil {
+				dbShare.Expiration = t
+			} else {
+				log.Warn().Msgf("ignoring invalid share expiration: id:%d expiration:%q", id, expiration)
+			}
+		}
 		shares = append(shares, dbShare)
 
 	}
@@ -345,7 +400,7 @@ func updateShareOwner(shareId int, newOwner string) {
 	stmtString := "update oc_share set uid_owner=? where id=?"
 	stmt, err := db.Prepare(stmtString)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "error updating share owner for id=%s with new owner=%s\n", shareId, newOwner)
+		fmt.Fprintf(os.Stderr, "error updating share owner for id=%d with new owner=%s\n", shareId, newOwner)
 		er(err)
 	}
 
@@ -0,0 +1,233 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+	"github.com/tj/go-spin"
+	"gopkg.in/ldap.v3"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+func init() {
+	shareCmd.AddCommand(shareEGroupsCmd)
+
+	shareEGroupsCmd.Flags().StringP("owner", "o", "", "only e-groups of the shares of this owner")
+	shareEGroupsCmd.Flags().Bool("problems", false, "only show e-groups that do not exist, are empty or have no active members")
+	shareEGroupsCmd.Flags().IntP("concurrency", "c", 20, "use up to <n> concurrent LDAP lookups")
+	shareEGroupsCmd.Flags().String("export", "", "writes the shares whose e-group resolves to zero active users into this file")
+}
+
+var shareEGroupsCmd = &cobra.Command{
+	Use:   "egroups",
+	Short: "Validates the e-groups that shares are given to, counting their effective active members",
+	Run: func(cmd *cobra.Command, args []string) {
+		owner, _ := cmd.Flags().GetString("owner")
+		problems, _ := cmd.Flags().GetBool("problems")
+		conc, _ := cmd.Flags().GetInt("concurrency")
+		export, _ := cmd.Flags().GetString("export")
+
+		query := "select " + shareColumns + " from oc_share where share_type=1"
+		qargs := []interface{}{}
+		if owner = strings.TrimSpace(owner); owner != "" {
+			query += " and uid_owner=?"
+			qargs = append(qargs, owner)
+		}
+		shares, err := getShares(query, qargs)
+		if err != nil {
+			er(err)
+		}
+
+		byGroup := map[string][]*dbShare{}
+		for _, s := range shares {
+			byGroup[s.ShareWith] = append(byGroup[s.ShareWith], s)
+		}
+		names := make([]string, 0, len(byGroup))
+		for g := range byGroup {
+			names = append(names, g)
+		}
+		sort.Strings(names)
+
+		infos := getEGroupInfos(names, conc)
+
+		cols := []string{"EGROUP", "STATUS", "MEMBERS", "ACTIVE", "SHARES"}
+		rows := [][]string{}
+		exportRows := [][]string{}
+		for _, g := range names {
+			info, ok := infos[g]
+			if !ok {
+				rows = append(rows, []string{g, egroupUnknown, "-", "-", fmt.Sprintf("%d", len(byGroup[g]))})
+				continue
+			}
+			status := info.status()
+			if problems && status == egroupOK {
+				continue
+			}
+			rows = append(rows, []string{g, status, fmt.Sprintf("%d", info.members), fmt.Sprintf("%d", info.active), fmt.Sprintf("%d", len(byGroup[g]))})
+			if info.active == 0 {
+				for _, s := range byGroup[g] {
+					exportRows = append(exportRows, []string{fmt.Sprintf("%d", s.ID), s.UIDOwner, g, status, s.HumanPerm(), s.HumanSTime(), s.FileID()})
+				}
+			}
+		}
+
+		pretty(cols, rows)
+		if export != "" {
+			save([]string{"ID", "OWNER", "EGROUP", "STATUS", "PERMISSION", "CREATED", "FILEID"}, exportRows, export)
+			fmt.Fprintf(os.Stderr, "%d shares to e-groups without active members exported to %s\n", len(exportRows), export)
+		}
+	},
+}
+
+// Status of an e-group share recipient.
+const (
+	egroupOK       = "ok"
+	egroupMissing  = "missing"
+	egroupEmpty    = "empty"
+	egroupInactive = "no-active-members"
+	egroupUnknown  = "unknown" // LDAP lookup failed
+)
+
+const egroupsBaseDN = "OU=e-groups,OU=Workgroups,DC=cern,DC=ch"
+
+type egroupInfo struct {
+	dn      string // empty if the e-group does not exist
+	members int    // direct members, users and groups
+	active  int    // enabled users, including the ones of nested groups
+}
+
+func (e *egroupInfo) status() string {
+	switch {
+	case e.dn == "":
+		return egroupMissing
+	case e.members == 0:
+		return egroupEmpty
+	case e.active == 0:
+		return egroupInactive
+	}
+	return egroupOK
+}
+
+// getEGroupInfos looks up e-groups concurrently. E-groups whose lookup
+// failed are missing from the result.
+var getEGroupInfos = func(names []string, concurrency int) map[string]*egroupInfo {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	pool := newLDAPPool()
+	defer pool.close()
+
+	var throttle = make(chan int, concurrency)
+	var wg sync.WaitGroup
+	var mux sync.Mutex
+	s := spin.New()
+	m := make(map[string]*egroupInfo, len(names))
+	done := 0
+	for _, name := range names {
+		throttle <- 1
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			defer func() {
+				<-throttle
+			}()
+
+			var info *egroupInfo
+			err := pool.do(name, func(l *ldap.Conn) (err error) {
+				info, err = lookupEGroup(l, name)
+				return
+			})
+			mux.Lock()
+			defer mux.Unlock()
+			if err == nil {
+				m[name] = info
+			}
+			done++
+			fmt.Fprintf(os.Stderr, "\r %s Getting e-group info [%d/%d]", s.Next(), done, len(names))
+		}(name)
+	}
+	wg.Wait()
+	fmt.Fprintln(os.Stderr)
+	pool.printFailures()
+	return m
+}
+
+// lookupEGroup finds the e-group called name and counts its members. A
+// missing e-group is not an error, an egroupInfo without dn is returned.
+func lookupEGroup(l *ldap.Conn, name string) (*egroupInfo, error) {
+	dn, err := getEGroupDN(l, name)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &egroupInfo{dn: dn}
+	if dn == "" {
+		return info, nil
+	}
+	members, err := searchGroupMembers(l, dn, "", false, []string{"cn"})
+	if err != nil {
+		return nil, err
+	}
+	info.members = len(members)
+	if info.members == 0 {
+		return info, nil
+	}
+
+	// disabled accounts have the ACCOUNTDISABLE bit of userAccountControl set
+	active, err := searchGroupMembers(l, dn, "(objectClass=user)(!(userAccountControl:1.2.840.113556.1.4.803:=2))", true, []string{"cn"})
+	if err != nil {
+		return nil, err
+	}
+	info.active = len(active)
+	return info, nil
+}
+
+// getEGroupDN returns the dn of the e-group called name, or an empty string
+// if it does not exist.
+func getEGroupDN(l *ldap.Conn, name string) (string, error) {
+	searchRequest := ldap.NewSearchRequest(
+		egroupsBaseDN,
+		ldap.ScopeSingleLevel, ldap.NeverDerefAliases, 0, 0, false,
+		fmt.Sprintf("(&(objectClass=group)(cn=%s))", ldap.EscapeFilter(name)),
+		[]string{"cn"},
+		nil,
+	)
+	sr, err := l.Search(searchRequest)
+	if err != nil {
+		return "", err
+	}
+	if len(sr.Entries) == 0 {
+		return "", nil
+	}
+	return sr.Entries[0].DN, nil
+}
+
+// searchGroupMembers returns the entries matching filter that are members of
+// the group dn, sorted by dn. Only direct members are returned unless nested
+// is set, in which case nested groups are expanded on the server with
+// LDAP_MATCHING_RULE_IN_CHAIN. The search is paged and covers the whole
+// directory, so members of big groups and in any OU are all found.
+func searchGroupMembers(l *ldap.Conn, dn, filter string, nested bool, attributes []string) ([]*ldap.Entry, error) {
+	rule := "memberOf"
+	if nested {
+		rule = "memberOf:1.2.840.113556.1.4.1941:"
+	}
+	searchRequest := ldap.NewSearchRequest(
+		"DC=cern,DC=ch",
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+		fmt.Sprintf("(&%s(%s=%s))", filter, rule, ldap.EscapeFilter(dn)),
+		attributes,
+		nil,
+	)
+	sr, err := l.SearchWithPaging(searchRequest, 1000)
+	if err != nil {
+		return nil, err
+	}
+	entries := sr.Entries
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].DN < entries[j].DN
+	})
+	return entries, nil
+}
@@ -0,0 +1,182 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+	"github.com/tj/go-spin"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+func init() {
+	shareCmd.AddCommand(shareStaleCmd)
+
+	shareStaleCmd.Flags().Int("older-than", 365, "only shares created more than <n> days ago. 0 means any age")
+	shareStaleCmd.Flags().StringSlice("type", nil, "only shares of these types: user-share, egroup-share, public-link")
+	shareStaleCmd.Flags().Bool("departed", false, "only shares whose owner is no longer in LDAP. The age is not checked unless --older-than is given")
+	shareStaleCmd.Flags().Bool("check-owners", false, "look up the owners in LDAP to show if they have departed")
+	shareStaleCmd.Flags().IntP("concurrency", "c", 20, "use up to <n> concurrent LDAP lookups")
+	shareStaleCmd.Flags().String("out", "", "also writes the report into this file")
+}
+
+// oc_share does not record when a share is accessed, so shares are aged by
+// their creation time (stime) only.
+var shareStaleCmd = &cobra.Command{
+	Use:   "stale",
+	Short: "Reports old shares and shares of departed users",
+	Run: func(cmd *cobra.Command, args []string) {
+		olderThan, _ := cmd.Flags().GetInt("older-than")
+		types, _ := cmd.Flags().GetStringSlice("type")
+		departed, _ := cmd.Flags().GetBool("departed")
+		checkOwners, _ := cmd.Flags().GetBool("check-owners")
+		conc, _ := cmd.Flags().GetInt("concurrency")
+		out, _ := cmd.Flags().GetString("out")
+
+		if departed && !cmd.Flags().Changed("older-than") {
+			olderThan = 0
+		}
+		for _, t := range types {
+			if !isShareType(t) {
+				er(fmt.Sprintf("unknown share type %q", t))
+			}
+		}
+
+		shares, err := getAllShares()
+		if err != nil {
+			er(err)
+		}
+
+		now := time.Now()
+		stale := []*dbShare{}
+		for _, s := range shares {
+			if olderThan > 0 && s.age(now) < time.Duration(olderThan)*24*time.Hour {
+				continue
+			}
+			if len(types) > 0 && !contains(types, s.HumanType()) {
+				continue
+			}
+			stale = append(stale, s)
+		}
+
+		var status map[string]string
+		if departed || checkOwners {
+			status = getOwnersStatus(shareOwners(stale), conc)
+		}
+
+		cols := []string{"ID", "OWNER", "OWNERSTATUS", "TYPE", "SHARE_WITH", "PERMISSION", "CREATED", "DAYS", "FILEID"}
+		rows := [][]string{}
+		for _, s := range stale {
+			ownerStatus := "-"
+			if status != nil {
+				ownerStatus = status[s.UIDOwner]
+			}
+			if departed && ownerStatus != ownerDeparted {
+				continue
+			}
+			days := fmt.Sprintf("%d", int(s.age(now).Hours()/24))
+			rows = append(rows, []string{fmt.Sprintf("%d", s.ID), s.UIDOwner, ownerStatus, s.HumanType(), s.HumanShareWith(), s.HumanPerm(), s.HumanSTime(), days, s.FileID()})
+		}
+
+		pretty(cols, rows)
+		if out != "" {
+			save(cols, rows, out)
+		}
+	},
+}
+
+// Status of the owner of a share.
+const (
+	ownerActive   = "active"
+	ownerDeparted = "departed"
+	ownerUnknown  = "unknown" // LDAP lookup failed
+)
+
+var shareTypes = []string{"user-share", "egroup-share", "public-link"}
+
+func isShareType(t string) bool {
+	return contains(shareTypes, t)
+}
+
+func contains(list []string, v string) bool {
+	for _, e := range list {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
+
+// shareOwners returns the distinct owners of shares, sorted.
+func shareOwners(shares []*dbShare) []string {
+	uniq := map[string]bool{}
+	for _, s := range shares {
+		uniq[s.UIDOwner] = true
+	}
+	owners := make([]string, 0, len(uniq))
+	for o := range uniq {
+		owners = append(owners, o)
+	}
+	sort.Strings(owners)
+	return owners
+}
+
+// getOwnersStatus looks up accounts in LDAP and tells if they are still
+// there.
+func getOwnersStatus(accounts []string, concurrency int) map[string]string {
+	infos := getAccountsInfo(accounts, concurrency)
+	status := make(map[string]string, len(accounts))
+	for _, a := range accounts {
+		ui, ok := infos[a]
+		switch {
+		case !ok:
+			status[a] = ownerUnknown
+		case ui.Account == "":
+			status[a] = ownerDeparted
+		default:
+			status[a] = ownerActive
+		}
+	}
+	return status
+}
+
+// getAccountsInfo looks up accounts in LDAP concurrently. Accounts whose
+// lookup failed are missing from the result.
+var getAccountsInfo = func(accounts []string, concurrency int) map[string]*userInfo {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	pool := newLDAPPool()
+	defer pool.close()
+
+	var throttle = make(chan int, concurrency)
+	var wg sync.WaitGroup
+	var mux sync.Mutex
+	s := spin.New()
+	m := make(map[string]*userInfo, len(accounts))
+	done := 0
+	for _, a := range accounts {
+		throttle <- 1
+		wg.Add(1)
+		go func(a string) {
+			defer wg.Done()
+			defer func() {
+				<-throttle
+			}()
+
+			ui, err := getAccountInfo(pool, a)
+			mux.Lock()
+			defer mux.Unlock()
+			if err == nil {
+				m[a] = ui
+			}
+			done++
+			fmt.Fprintf(os.Stderr, "\r %s Getting account info [%d/%d]", s.Next(), done, len(accounts))
+		}(a)
+	}
+	wg.Wait()
+	fmt.Fprintln(os.Stderr)
+	pool.printFailures()
+	return m
+}
@@ -0,0 +1,204 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/spf13/cobra"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+func init() {
+	shareCmd.AddCommand(shareStatsCmd)
+
+	shareStatsCmd.Flags().StringSlice("by", shareStatsDims, "dimensions to aggregate by: "+strings.Join(shareStatsDims, ", "))
+	shareStatsCmd.Flags().StringSlice("type", nil, "only count shares of these types: user-share, egroup-share, public-link")
+	shareStatsCmd.Flags().IntP("top", "t", 20, "only show the <n> biggest entries of the instance and owner dimensions. 0 shows all")
+	shareStatsCmd.Flags().StringP("format", "f", "table", "output format: table or json")
+	shareStatsCmd.Flags().Bool("histogram", false, "adds a histogram bar to the tables")
+}
+
+var shareStatsDims = []string{"type", "permission", "instance", "owner", "month"}
+
+var shareStatsCmd = &cobra.Command{
+	Use:   "stats",
+	Short: "Aggregates the shares by type, permission, instance, owner and creation month",
+	Run: func(cmd *cobra.Command, args []string) {
+		dims, _ := cmd.Flags().GetStringSlice("by")
+		types, _ := cmd.Flags().GetStringSlice("type")
+		top, _ := cmd.Flags().GetInt("top")
+		format, _ := cmd.Flags().GetString("format")
+		histogram, _ := cmd.Flags().GetBool("histogram")
+
+		for _, d := range dims {
+			if !contains(shareStatsDims, d) {
+				er(fmt.Sprintf("unknown dimension %q, expected one of %s", d, strings.Join(shareStatsDims, ", ")))
+			}
+		}
+		for _, t := range types {
+			if !isShareType(t) {
+				er(fmt.Sprintf("unknown share type %q", t))
+			}
+		}
+		if format != "table" && format != "json" {
+			er("--format must be table or json")
+		}
+
+		shares, err := getAllShares()
+		if err != nil {
+			er(err)
+		}
+		if len(types) > 0 {
+			filtered := []*dbShare{}
+			for _, s := range shares {
+				if contains(types, s.HumanType()) {
+					filtered = append(filtered, s)
+				}
+			}
+			shares = filtered
+		}
+
+		stats := &shareStats{Total: len(shares), Dimensions: map[string][]*shareCount{}}
+		for _, d := range dims {
+			stats.Dimensions[d] = countShares(shares, d, top)
+		}
+
+		if format == "json" {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			if err := enc.Encode(stats); err != nil {
+				er(err)
+			}
+			return
+		}
+
+		for i, d := range dims {
+			if i > 0 {
+				fmt.Println()
+			}
+			fmt.Printf("Shares by %s\n", d)
+			cols := []string{strings.ToUpper(d), "SHARES", "PERCENT"}
+			if histogram {
+				cols = append(cols, "")
+			}
+			rows := [][]string{}
+			for _, c := range stats.Dimensions[d] {
+				row := []string{c.Key, fmt.Sprintf("%d", c.Count), fmt.Sprintf("%.1f%%", percent(c.Count, stats.Total))}
+				if histogram {
+					row = append(row, histogramBar(c.Count, stats.Dimensions[d]))
+				}
+				rows = append(rows, row)
+			}
+			pretty(cols, rows)
+		}
+		fmt.Printf("\nTotal: %d shares\n", stats.Total)
+	},
+}
+
+type shareStats struct {
+	Total      int                      `json:"total"`
+	Dimensions map[string][]*shareCount `json:"dimensions"`
+}
+
+type shareCount struct {
+	Key   string `json:"key"`
+	Count int    `json:"count"`
+}
+
+// shareDimension returns the value of dim for s.
+func shareDimension(s *dbShare, dim string) string {
+	switch dim {
+	case "type":
+		return s.HumanType()
+	case "permission":
+		return permissionLabel(s.Permissions)
+	case "instance":
+		if s.Prefix == "" {
+			return "-"
+		}
+		return getTopology().prefixName(s.Prefix)
+	case "owner":
+		return s.UIDOwner
+	case "month":
+		return time.Unix(int64(s.STime), 0).Format("2006-01")
+	}
+	return ""
+}
+
+const sharePermReadWrite = sharePermRead | sharePermUpdate | sharePermCreate | sharePermDelete
+
+// sharePermissionLabels names the usual oc_share permission bitmasks.
+var sharePermissionLabels = map[int]string{
+	sharePermRead:                       "read-only",
+	sharePermCreate:                     "upload-only",
+	sharePermRead | sharePermCreate:     "read-upload",
+	sharePermReadWrite:                  "read-write",
+	sharePermRead | sharePermShare:      "read-only+share",
+	sharePermReadWrite | sharePermShare: "read-write+share",
+}
+
+// permissionLabel names the permission bitmask perm, keeping the raw value so
+// different bitmasks are never counted together.
+func permissionLabel(perm int) string {
+	if l, ok := sharePermissionLabels[perm]; ok {
+		return fmt.Sprintf("%s (%d)", l, perm)
+	}
+	return fmt.Sprintf("other (%d)", perm)
+}
+
+// countShares counts the shares per value of dim. Months are sorted in
+// chronological order, the other dimensions by count and cut to the top
+// entries for instance and owner.
+func countShares(shares []*dbShare, dim string, top int) []*shareCount {
+	counts := map[string]int{}
+	for _, s := range shares {
+		counts[shareDimension(s, dim)]++
+	}
+
+	list := make([]*shareCount, 0, len(counts))
+	for k, n := range counts {
+		list = append(list, &shareCount{Key: k, Count: n})
+	}
+
+	if dim == "month" {
+		sort.Slice(list, func(i, j int) bool {
+			return list[i].Key < list[j].Key
+		})
+		return list
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Count != list[j].Count {
+			return list[i].Count > list[j].Count
+		}
+		return list[i].Key < list[j].Key
+	})
+	if (dim == "instance" || dim == "owner") && top > 0 && len(list) > top {
+		list = list[:top]
+	}
+	return list
+}
+
+func percent(n, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(n) * 100 / float64(total)
+}
+
+// histogramBar draws n relative to the biggest count of counts.
+func histogramBar(n int, counts []*shareCount) string {
+	const width = 40
+	max := 0
+	for _, c := range counts {
+		if c.Count > max {
+			max = c.Count
+		}
+	}
+	if max == 0 {
+		return ""
+	}
+	return strings.Repeat("#", (n*width+max-1)/max)
+}
@@ -0,0 +1,323 @@
+package cmd
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/spf13/cobra"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+func init() {
+	shareCmd.AddCommand(shareTransferUserCmd)
+
+	shareTransferUserCmd.Flags().StringArrayP("map", "m", nil, "<old-path>=<new-path> where the data of the user has been moved to, can be repeated (required)")
+	shareTransferUserCmd.Flags().Bool("dry-run", false, "shows the mapping without changing any share")
+	shareTransferUserCmd.Flags().BoolP("yes", "y", false, "transfers the shares without confirmation")
+	shareTransferUserCmd.Flags().String("report", "", "writes the mapping report into this file")
+}
+
+var shareTransferUserCmd = &cobra.Command{
+	Use:   "transfer-user <old-owner> <new-owner> --map <old-path>=<new-path>\nExample: cernboxcop sharing transfer-user jdoe gonzalhu --map /eos/user/j/jdoe/Analysis=/eos/project/c/cernbox/Analysis",
+	Short: "Re-creates the shares of a departed user for a new owner, after their data has been moved",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 2 {
+			exit(cmd)
+		}
+
+		oldOwner := strings.TrimSpace(args[0])
+		newOwner := strings.TrimSpace(args[1])
+		maps, _ := cmd.Flags().GetStringArray("map")
+		dryRun, _ := cmd.Flags().GetBool("dry-run")
+		yes, _ := cmd.Flags().GetBool("yes")
+		report, _ := cmd.Flags().GetString("report")
+
+		if oldOwner == "" || newOwner == "" || oldOwner == newOwner {
+			er("old and new owner must be different accounts")
+		}
+		mappings, err := parsePathMappings(maps)
+		if err != nil {
+			er(err)
+		}
+		if len(mappings) == 0 {
+			er("at least one --map is required")
+		}
+
+		shares, err := getSharesByOwner(oldOwner)
+		if err != nil {
+			er(err)
+		}
+		if len(shares) == 0 {
+			fmt.Fprintf(os.Stderr, "%s has no shares\n", oldOwner)
+			return
+		}
+
+		db := getDB()
+		defer db.Close()
+		transfers, err := planShareTransfers(db, shares, mappings, newOwner)
+		if err != nil {
+			er(err)
+		}
+
+		if !dryRun {
+			ready := 0
+			for _, t := range transfers {
+				if t.status == transferReady {
+					ready++
+				}
+			}
+			if ready > 0 && !yes {
+				cols, rows := shareTransferRows(transfers)
+				pretty(cols, rows)
+				msg := fmt.Sprintf("Are you sure to transfer %d shares from %q to %q?\n", ready, oldOwner, newOwner)
+				if !askForConfirmation(msg) {
+					fmt.Fprintf(os.Stderr, "Aborted\n")
+					os.Exit(1)
+				}
+			}
+			for _, t := range transfers {
+				if t.status == transferReady {
+					t.apply(db, newOwner)
+				}
+			}
+		}
+
+		cols, rows := shareTransferRows(transfers)
+		pretty(cols, rows)
+		if report != "" {
+			save(cols, rows, report)
+		}
+	},
+}
+
+// pathMapping is a directory whose content was moved to another one.
+type pathMapping struct{ from, to string }
+
+// parsePathMappings parses old=new pairs, sorted with the most specific old
+// path first.
+func parsePathMappings(maps []string) ([]*pathMapping, error) {
+	mappings := []*pathMapping{}
+	for _, m := range maps {
+		tokens := strings.SplitN(m, "=", 2)
+		if len(tokens) != 2 || !path.IsAbs(tokens[0]) || !path.IsAbs(tokens[1]) {
+			return nil, fmt.Errorf("invalid mapping %q, expected <old-path>=<new-path> with absolute paths", m)
+		}
+		mappings = append(mappings, &pathMapping{from: path.Clean(tokens[0]), to: path.Clean(tokens[1])})
+	}
+	sort.Slice(mappings, func(i, j int) bool {
+		return len(mappings[i].from) > len(mappings[j].from)
+	})
+	return mappings, nil
+}
+
+// mapPath returns where file is after the move. A file already under one of
+// the new paths, e.g. moved with eos mv keeping its inode, is returned as is.
+func mapPath(file string, mappings []*pathMapping) (string, bool) {
+	file = path.Clean(file)
+	for _, m := range mappings {
+		if file == m.from || strings.HasPrefix(file, m.from+"/") {
+			return m.to + strings.TrimPrefix(file, m.from), true
+		}
+	}
+	for _, m := range mappings {
+		if file == m.to || strings.HasPrefix(file, m.to+"/") {
+			return file, true
+		}
+	}
+	return "", false
+}
+
+// Status of a share transfer.
+const (
+	transferReady       = "ready"
+	transferDone        = "transferred"
+	transferOldNotFound = "old-not-found" // the shared file no longer exists
+	transferUnmapped    = "unmapped"      // no --map covers the shared file
+	transferNewNotFound = "new-not-found" // the mapped file does not exist
+	transferNotAdmin    = "not-admin"     // new owner cannot share in the project
+	transferFailed      = "failed"
+)
+
+type shareTransfer struct {
+	share     *dbShare
+	oldPath   string
+	newPath   string
+	newPrefix string
+	newInode  uint64
+	newID     int64
+	status    string
+	err       error
+}
+
+// planShareTransfers resolves where every share points to after the move.
+func planShareTransfers(db *sql.DB, shares []*dbShare, mappings []*pathMapping, newOwner string) ([]*shareTransfer, error) {
+	known, err := getFileIDPrefixes(db)
+	if err != nil {
+		return nil, err
+	}
+
+	t := getTopology()
+	var projects []*projectSpace    // loaded on first use
+	admins := map[string]bool{}     // project space => new owner is admin
+	prefixes := map[string]string{} // mgm => fileid prefix, empty if unknown
+	transfers := make([]*shareTransfer, 0, len(shares))
+	for _, s := range shares {
+		tr := &shareTransfer{share: s, oldPath: s.GetPath()}
+		transfers = append(transfers, tr)
+
+		if tr.oldPath == "-" {
+			tr.status = transferOldNotFound
+			continue
+		}
+		newPath, ok := mapPath(tr.oldPath, mappings)
+		if !ok {
+			tr.status = transferUnmapped
+			continue
+		}
+		tr.newPath = newPath
+
+		ns, letter, space := t.locate(newPath)
+		if ns == nil {
+			tr.status, tr.err = transferFailed, fmt.Errorf("%s is outside the eos topology", newPath)
+			continue
+		}
+
+		if ns.Name == "project" {
+			isAdmin, ok := admins[space]
+			if !ok {
+				if projects == nil {
+					projects = getProjectSpaces("")
+				}
+				project, err := findProject(projects, space)
+				if err != nil {
+					tr.status, tr.err = transferFailed, fmt.Errorf("project space %s: %v", space, err)
+					continue
+				}
+				isAdmin = isProjectAdmin(newOwner, project)
+				admins[space] = isAdmin
+			}
+			if !isAdmin {
+				tr.status = transferNotAdmin
+				continue
+			}
+		}
+
+		mgm := t.mgm(ns, letter)
+		fi, err := getEOS(mgm).GetFileInfoByPath(getCtx(), "root", newPath)
+		if err != nil {
+			tr.status, tr.err = transferNewNotFound, err
+			continue
+		}
+		tr.newInode = fi.Inode
+		prefix, ok := prefixes[mgm]
+		if !ok {
+			prefix = fileIDPrefix(known, mgm)
+			prefixes[mgm] = prefix
+		}
+		if prefix == "" {
+			tr.status, tr.err = transferFailed, fmt.Errorf("unknown fileid prefix for %s", mgm)
+			continue
+		}
+		tr.newPrefix = prefix
+		tr.status = transferReady
+	}
+	return transfers, nil
+}
+
+// apply re-creates the share for newOwner pointing to the new file and
+// removes the old row, in a single transaction.
+func (tr *shareTransfer) apply(db *sql.DB, newOwner string) {
+	fail := func(err error) {
+		tr.status, tr.err = transferFailed, err
+		log.Error().Msgf("error transferring share: id:%d err:%+v", tr.share.ID, err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		fail(err)
+		return
+	}
+
+	inode := fmt.Sprintf("%d", tr.newInode)
+	res, err := tx.Exec("insert into oc_share (share_type, share_with, uid_owner, uid_initiator, parent, item_type, item_source, item_target, file_source, file_target, permissions, stime, accepted, expiration, token, mail_send, fileid_prefix, orphan, share_name) "+
+		"select share_type, share_with, ?, ?, parent, item_type, ?, item_target, ?, file_target, permissions, ?, accepted, expiration, token, mail_send, ?, 0, share_name from oc_share where id=?",
+		newOwner, newOwner, inode, inode, time.Now().Unix(), tr.newPrefix, tr.share.ID)
+	if err == nil {
+		tr.newID, err = res.LastInsertId()
+	}
+	if err == nil {
+		_, err = tx.Exec("delete from oc_share where id=?", tr.share.ID)
+	}
+	if err != nil {
+		tx.Rollback()
+		fail(err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		fail(err)
+		return
+	}
+
+	tr.status = transferDone
+	log.Info().Msgf("share transferred: old_id:%d new_id:%d old_owner:%s new_owner:%s old_path:%s new_path:%s", tr.share.ID, tr.newID, tr.share.UIDOwner, newOwner, tr.oldPath, tr.newPath)
+}
+
+// getFileIDPrefixes returns the fileid prefixes used in oc_share.
+func getFileIDPrefixes(db *sql.DB) ([]string, error) {
+	rows, err := db.Query("select distinct fileid_prefix from oc_share where fileid_prefix is not null")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	prefixes := []string{}
+	for rows.Next() {
+		var prefix string
+		if err := rows.Scan(&prefix); err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes, rows.Err()
+}
+
+// fileIDPrefix returns the oc_share fileid_prefix of the instance mgm, the
+// one of prefixes already used by other shares of the instance. It returns
+// an empty string if no share uses the instance, as guessing a prefix the
+// frontend does not know would break the share.
+func fileIDPrefix(prefixes []string, mgm string) string {
+	t := getTopology()
+	for _, prefix := range prefixes {
+		if t.prefixMGM(prefix) == mgm {
+			return prefix
+		}
+	}
+	return ""
+}
+
+func shareTransferRows(transfers []*shareTransfer) ([]string, [][]string) {
+	cols := []string{"OLDID", "NEWID", "TYPE", "SHARE_WITH", "OLDFILEID", "OLDPATH", "NEWFILEID", "NEWPATH", "STATUS", "ERROR"}
+	rows := [][]string{}
+	for _, tr := range transfers {
+		newID, newFileID := "-", "-"
+		if tr.newID != 0 {
+			newID = fmt.Sprintf("%d", tr.newID)
+		}
+		if tr.newInode != 0 {
+			newFileID = fmt.Sprintf("%s:%d", getTopology().prefixName(tr.newPrefix), tr.newInode)
+		}
+		errMsg := ""
+		if tr.err != nil {
+			errMsg = strings.Replace(tr.err.Error(), "\n", " ", -1)
+		}
+		with := tr.share.HumanShareWith()
+		if tr.share.ShareType == 3 {
+			with = tr.share.Token
+		}
+		rows = append(rows, []string{fmt.Sprintf("%d", tr.share.ID), newID, tr.share.HumanType(), with, tr.share.FileID(), tr.oldPath, newFileID, tr.newPath, tr.status, errMsg})
+	}
+	return cols, rows
+}
@@ -0,0 +1,275 @@
+package cmd
+
+import (
+	"crypto/sha1"
+	"encoding/csv"
+	"fmt"
+	"github.com/spf13/cobra"
+	htmltemplate "html/template"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+)
+
+func init() {
+	accountingCmd.AddCommand(accountingStatementsCmd)
+
+	accountingStatementsCmd.Flags().StringP("report", "r", ".", "directory containing the accounting.txt of the report run")
+	accountingStatementsCmd.Flags().StringP("out", "o", "statements", "directory to write the statements into")
+	accountingStatementsCmd.Flags().StringP("period", "p", time.Now().Local().Format("2006-01"), "billing period of the statements (YYYY-MM)")
+	accountingStatementsCmd.Flags().StringSliceP("format", "f", []string{"md", "html", "csv"}, "formats to render: md, html, csv")
+	accountingStatementsCmd.Flags().StringP("group", "g", "", "only render the statement of this charge group")
+	accountingStatementsCmd.Flags().Float64P("cost", "", 2.20, "cost factor for CHF/TBMonth used when cost_model does not define a rate")
+}
+
+var accountingStatementsCmd = &cobra.Command{
+	Use:   "statements",
+	Short: "Renders a statement per charge group from a report run",
+	Run: func(cmd *cobra.Command, args []string) {
+		report, _ := cmd.Flags().GetString("report")
+		out, _ := cmd.Flags().GetString("out")
+		period, _ := cmd.Flags().GetString("period")
+		formats, _ := cmd.Flags().GetStringSlice("format")
+		onlyGroup, _ := cmd.Flags().GetString("group")
+		factorPerTB, _ := cmd.Flags().GetFloat64("cost")
+
+		if _, err := time.Parse("2006-01", period); err != nil {
+			er(fmt.Sprintf("invalid period %q, expected YYYY-MM", period))
+		}
+
+		renderers := map[string]func(io.Writer, *statement) error{
+			"md":   renderStatementMarkdown,
+			"html": renderStatementHTML,
+			"csv":  renderStatementCSV,
+		}
+		for _, f := range formats {
+			if _, ok := renderers[f]; !ok {
+				er(fmt.Sprintf("unknown format %q", f))
+			}
+		}
+
+		file := path.Join(report, "accounting.txt")
+		fd, err := os.Open(file)
+		if err != nil {
+			er(err)
+		}
+		rows, err := parseReport(fd)
+		fd.Close()
+		if err != nil {
+			er(fmt.Sprintf("error parsing %s: %+v", file, err))
+		}
+
+		model := getCostModel(factorPerTB)
+		statements := buildStatements(rows, model, period)
+		dir := path.Join(out, period)
+		os.MkdirAll(dir, 0755)
+		for _, st := range statements {
+			if onlyGroup != "" && st.ChargeGroup != onlyGroup {
+				continue
+			}
+			for _, f := range formats {
+				name := path.Join(dir, fmt.Sprintf("%s.%s", statementFileName(st.ChargeGroup), f))
+				w, err := os.Create(name)
+				if err != nil {
+					er(err)
+				}
+				if err := renderers[f](w, st); err != nil {
+					er(err)
+				}
+				w.Close()
+				fmt.Println(name)
+			}
+		}
+	},
+}
+
+type statement struct {
+	ID          string
+	ChargeGroup string
+	Period      string
+	Generated   string
+	Items       []*statementItem
+	TotalUsed   int
+	TotalQuota  int
+	TotalCost   string
+}
+
+type statementItem struct {
+	Kind       string
+	Path       string
+	Spaces     int // spaces sharing the quota node
+	Account    string
+	ChargeRole string
+	Used       int
+	Quota      int
+	Cost       string
+	rank       int // position in the statement, see statementRank
+}
+
+func (i *statementItem) UsedH() string  { return humanQuota(i.Used) }
+func (i *statementItem) QuotaH() string { return humanQuota(i.Quota) }
+
+func (s *statement) TotalUsedH() string  { return humanQuota(s.TotalUsed) }
+func (s *statement) TotalQuotaH() string { return humanQuota(s.TotalQuota) }
+
+// statementID is stable for a charge group and period, so re-rendering a
+// statement does not change its reference.
+func statementID(group, period string) string {
+	sum := sha1.Sum([]byte(group))
+	return fmt.Sprintf("CBX-%s-%x", strings.Replace(period, "-", "", 1), sum[:4])
+}
+
+var notFileSafe = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+func statementFileName(group string) string {
+	return notFileSafe.ReplaceAllString(group, "_")
+}
+
+// buildStatements groups the rows of accounting.txt by charge group. Every item
+// is a quota node as in the aggregates: spaces sharing a node are listed once,
+// under the lowest path, in the charge group of that path. Nodes without a
+// valid charge group are skipped.
+func buildStatements(rows []map[string]string, model *costModel, period string) []*statement {
+	byGroup := map[string]*statement{}
+	costs := map[string]float64{}
+	generated := time.Now().Local().Format("2006-01-02")
+	for _, n := range quotaNodes(reportInfos(rows)) {
+		group := n.space.chargeInfo.ChargeGroup
+		if group == "" || group == "Unknown" {
+			continue
+		}
+		st, ok := byGroup[group]
+		if !ok {
+			st = &statement{ID: statementID(group, period), ChargeGroup: group, Period: period, Generated: generated}
+			byGroup[group] = st
+		}
+
+		in := newCostInput(n.space)
+		cost := model.cost(in)
+		ns := getTopology().namespaceOfPath(in.path)
+		kind := "Other space"
+		if ns != nil {
+			kind = ns.label()
+		}
+
+		st.Items = append(st.Items, &statementItem{
+			Kind:       kind,
+			Path:       in.path,
+			Spaces:     n.spaces,
+			Account:    in.account,
+			ChargeRole: n.space.chargeInfo.ChargeRole,
+			Used:       in.used,
+			Quota:      in.quota,
+			Cost:       model.format(cost),
+			rank:       statementRank(ns),
+		})
+		st.TotalUsed += in.used
+		st.TotalQuota += in.quota
+		costs[group] += cost
+	}
+
+	statements := make([]*statement, 0, len(byGroup))
+	for group, st := range byGroup {
+		st.TotalCost = model.format(costs[group])
+		sort.Slice(st.Items, func(i, j int) bool {
+			if st.Items[i].rank != st.Items[j].rank {
+				return st.Items[i].rank < st.Items[j].rank
+			}
+			return st.Items[i].Path < st.Items[j].Path
+		})
+		statements = append(statements, st)
+	}
+	sort.Slice(statements, func(i, j int) bool {
+		return statements[i].ChargeGroup < statements[j].ChargeGroup
+	})
+	return statements
+}
+
+// statementRank orders the items of a statement by namespace: project spaces
+// first, then the other namespaces in the order of the topology and last the
+// paths outside of it.
+func statementRank(ns *eosNamespace) int {
+	namespaces := getTopology().Namespaces
+	if ns == nil {
+		return len(namespaces) + 1
+	}
+	if ns.Name == "project" {
+		return 0
+	}
+	for i, n := range namespaces {
+		if n == ns {
+			return i + 1
+		}
+	}
+	return len(namespaces)
+}
+
+const statementMarkdown = `# CERNBox storage statement {{.ID}}
+
+| | |
+|---|---|
+| Charge group | {{.ChargeGroup}} |
+| Period | {{.Period}} |
+| Generated | {{.Generated}} |
+
+| Type | Path | Account | Charge role | Used | Quota | Cost |
+|---|---|---|---|---|---|---|
+{{range .Items}}| {{.Kind}} | {{.Path}}{{if gt .Spaces 1}} (+{{sub .Spaces 1}} sharing quota){{end}} | {{.Account}} | {{.ChargeRole}} | {{.UsedH}} | {{.QuotaH}} | {{.Cost}} |
+{{end}}| **Total** | | | | **{{.TotalUsedH}}** | **{{.TotalQuotaH}}** | **{{.TotalCost}}** |
+`
+
+const statementHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>CERNBox storage statement {{.ID}}</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: left; }
+tfoot td { font-weight: bold; }
+</style>
+</head>
+<body>
+<h1>CERNBox storage statement {{.ID}}</h1>
+<p>Charge group: {{.ChargeGroup}}<br>Period: {{.Period}}<br>Generated: {{.Generated}}</p>
+<table>
+<thead><tr><th>Type</th><th>Path</th><th>Account</th><th>Charge role</th><th>Used</th><th>Quota</th><th>Cost</th></tr></thead>
+<tbody>
+{{range .Items}}<tr><td>{{.Kind}}</td><td>{{.Path}}{{if gt .Spaces 1}} (+{{sub .Spaces 1}} sharing quota){{end}}</td><td>{{.Account}}</td><td>{{.ChargeRole}}</td><td>{{.UsedH}}</td><td>{{.QuotaH}}</td><td>{{.Cost}}</td></tr>
+{{end}}</tbody>
+<tfoot><tr><td>Total</td><td></td><td></td><td></td><td>{{.TotalUsedH}}</td><td>{{.TotalQuotaH}}</td><td>{{.TotalCost}}</td></tr></tfoot>
+</table>
+</body>
+</html>
+`
+
+var statementFuncs = map[string]interface{}{
+	"sub": func(a, b int) int { return a - b },
+}
+
+func renderStatementMarkdown(w io.Writer, st *statement) error {
+	t := template.Must(template.New("md").Funcs(statementFuncs).Parse(statementMarkdown))
+	return t.Execute(w, st)
+}
+
+func renderStatementHTML(w io.Writer, st *statement) error {
+	t := htmltemplate.Must(htmltemplate.New("html").Funcs(statementFuncs).Parse(statementHTML))
+	return t.Execute(w, st)
+}
+
+func renderStatementCSV(w io.Writer, st *statement) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"STATEMENT", "CHARGEGROUP", "PERIOD", "TYPE", "PATH", "ACC", "CHARGEROLE", "USEDBYTES", "MAXBYTES", "COSTH"})
+	for _, i := range st.Items {
+		cw.Write([]string{st.ID, st.ChargeGroup, st.Period, i.Kind, i.Path, i.Account, i.ChargeRole, fmt.Sprintf("%d", i.Used), fmt.Sprintf("%d", i.Quota), i.Cost})
+	}
+	cw.Write([]string{st.ID, st.ChargeGroup, st.Period, "Total", "", "", "", fmt.Sprintf("%d", st.TotalUsed), fmt.Sprintf("%d", st.TotalQuota), st.TotalCost})
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,51 @@
+package cmd
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBuildStatementsChargesNodeOnce(t *testing.T) {
+	model := &costModel{Currency: "CHF", costPlan: costPlan{Rate: 1, Basis: "used"}}
+	// two spaces of one quota node
+	rows := []map[string]string{
+		{"PATH": "/eos/project/c/beta", "ACC": "svc", "INSTANCE": "eosproject-c", "CHARGEGROUP": "IT", "USEDBYTES": "1000000000000", "MAXBYTES": "2000000000000"},
+		{"PATH": "/eos/project/c/alpha", "ACC": "svc", "INSTANCE": "eosproject-c", "CHARGEGROUP": "IT", "USEDBYTES": "1000000000000", "MAXBYTES": "2000000000000"},
+		{"PATH": "/eos/project/c/gamma", "ACC": "", "INSTANCE": "eosproject-c", "CHARGEGROUP": "Unknown", "USEDBYTES": "5", "MAXBYTES": "5"},
+	}
+
+	statements := buildStatements(rows, model, "2026-09")
+	if len(statements) != 1 {
+		t.Fatalf("buildStatements() returned %d statements, want 1", len(statements))
+	}
+	st := statements[0]
+	if st.ChargeGroup != "IT" || len(st.Items) != 1 || st.Items[0].Path != "/eos/project/c/alpha" || st.Items[0].Spaces != 2 {
+		t.Errorf("buildStatements() = group %s items %+v, want the node once in IT under /eos/project/c/alpha", st.ChargeGroup, st.Items)
+	}
+	if st.TotalUsed != 1000000000000 || st.TotalQuota != 2000000000000 {
+		t.Errorf("buildStatements() totals = %d/%d, want 1000000000000/2000000000000", st.TotalUsed, st.TotalQuota)
+	}
+}
+
+func TestBuildStatementsOrder(t *testing.T) {
+	model := &costModel{Currency: "CHF", costPlan: costPlan{Rate: 1, Basis: "used"}}
+	rows := []map[string]string{
+		{"PATH": "/eos/user/a/alice", "ACC": "alice", "INSTANCE": "eoshome-a", "CHARGEGROUP": "IT", "USEDBYTES": "1", "MAXBYTES": "2"},
+		{"PATH": "/data/other", "ACC": "other", "INSTANCE": "eosother", "CHARGEGROUP": "IT", "USEDBYTES": "1", "MAXBYTES": "2"},
+		{"PATH": "/eos/project/z/zeta", "ACC": "svczeta", "INSTANCE": "eosproject-z", "CHARGEGROUP": "IT", "USEDBYTES": "1", "MAXBYTES": "2"},
+		{"PATH": "/eos/project/a/alpha", "ACC": "svcalpha", "INSTANCE": "eosproject-a", "CHARGEGROUP": "IT", "USEDBYTES": "1", "MAXBYTES": "2"},
+	}
+
+	statements := buildStatements(rows, model, "2026-09")
+	if len(statements) != 1 {
+		t.Fatalf("buildStatements() returned %d statements, want 1", len(statements))
+	}
+	got := []string{}
+	for _, i := range statements[0].Items {
+		got = append(got, i.Path)
+	}
+	want := []string{"/eos/project/a/alpha", "/eos/project/z/zeta", "/eos/user/a/alice", "/data/other"}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("buildStatements() items = %v, want project spaces, then home directories, then other paths: %v", got, want)
+	}
+}
@@ -0,0 +1,335 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"path"
+	"strings"
+	"sync"
+)
+
+func init() {
+	viper.SetDefault("eos.namespaces", []map[string]interface{}{
+		{"name": "home", "mgm": "root://eoshome-%s.cern.ch", "dir": "/eos/user/%s", "quota_prefix": "/eos/user/",
+			"charge_role": "{account_type}", "simple_role": "CERNBox Home Directories", "label": "Home directory"},
+		{"name": "project", "mgm": "root://eosproject-%s.cern.ch", "dir": "/eos/project/%s", "quota_prefix": "/eos/project/",
+			"charge_role": "CERNBox Project {name}", "simple_role": "CERNBox Project Spaces", "label": "Project space", "report": true},
+	})
+	viper.SetDefault("eos.prefix_mgm", "root://%s.cern.ch")
+	// fileid prefixes use the internal names of the instances: newproject-c => eosproject-c
+	viper.SetDefault("eos.prefix_rewrites", []map[string]interface{}{{"from": "new", "to": "eos"}})
+	viper.SetDefault("eos.accounting_mgm", "root://eosproject-f.cern.ch")
+	viper.SetDefault("eos.accounting_dir", "/eos/project/f/fdo/www/accounting/data/cernbox/")
+
+	eosCmd.AddCommand(eosInstancesCmd)
+}
+
+var eosInstancesCmd = &cobra.Command{
+	Use:   "instances",
+	Short: "Shows the EOS instances used for every namespace and letter, after overrides and aliases",
+	Run: func(cmd *cobra.Command, args []string) {
+		t := getTopology()
+		cols := []string{"NAMESPACE", "LETTER", "DIR", "MGM", "QUOTAPREFIX"}
+		rows := [][]string{}
+		for _, ns := range t.Namespaces {
+			for _, l := range ns.letters() {
+				letter := l
+				if letter == "" {
+					letter = "-"
+				}
+				rows = append(rows, []string{ns.Name, letter, ns.dir(l), t.mgm(ns, l), ns.QuotaPrefix})
+			}
+		}
+		rows = append(rows, []string{"accounting", "-", t.AccountingDir, t.resolve(t.AccountingMGM), "-"})
+		pretty(cols, rows)
+	},
+}
+
+// eosTopology maps namespaces, letters and fileid prefixes to EOS instances.
+// It is read from the eos section of the config file:
+//
+//	[[eos.namespaces]]
+//	name = "home"
+//	mgm = "root://eoshome-%s.cern.ch"   # %s is the letter
+//	dir = "/eos/user/%s"                # spaces are the entries of dir
+//	quota_prefix = "/eos/user/"
+//	letters = "abcdefghijklmnopqrstuvwxyz"
+//	charge_role = "{account_type}"      # also {name}, {account} and {namespace}
+//	simple_role = "CERNBox Home Directories"
+//	label = "Home directory"            # used in statements
+//	report = false                      # reported by default by accounting report
+//	[[eos.namespaces]]                  # without %s the namespace is a single instance and dir
+//	name = "media"
+//	mgm = "root://eosmedia.cern.ch"
+//	dir = "/eos/media"
+//	quota_prefix = "/eos/media/"
+//	charge_role = "CERNBox Media {name}"
+//	report = true
+//	[[eos.overrides]]                   # instance of a single letter
+//	namespace = "home"
+//	letter = "a"
+//	mgm = "root://eoshome-a-new.cern.ch"
+//	[[eos.aliases]]                     # replaces an instance everywhere
+//	name = "root://eosproject-c.cern.ch"
+//	mgm = "root://localhost:1094"
+//	[[eos.prefix_rewrites]]             # applied to oc_share fileid prefixes
+//	from = "new"
+//	to = "eos"
+//
+// prefix_mgm builds the instance of a rewritten fileid prefix and
+// accounting_mgm and accounting_dir locate the published reports.
+type eosTopology struct {
+	Namespaces     []*eosNamespace `mapstructure:"namespaces"`
+	Overrides      []*eosOverride  `mapstructure:"overrides"`
+	Aliases        []*eosAlias     `mapstructure:"aliases"`
+	PrefixMGM      string          `mapstructure:"prefix_mgm"`
+	PrefixRewrites []*eosRewrite   `mapstructure:"prefix_rewrites"`
+	AccountingMGM  string          `mapstructure:"accounting_mgm"`
+	AccountingDir  string          `mapstructure:"accounting_dir"`
+}
+
+// eosNamespace is a tree of spaces, sharded by letter with one EOS instance
+// per letter if mgm and dir contain %s.
+type eosNamespace struct {
+	Name        string `mapstructure:"name"`
+	MGM         string `mapstructure:"mgm"`
+	Dir         string `mapstructure:"dir"`
+	QuotaPrefix string `mapstructure:"quota_prefix"`
+	Letters     string `mapstructure:"letters"`
+	ChargeRole  string `mapstructure:"charge_role"`
+	SimpleRole  string `mapstructure:"simple_role"`
+	Label       string `mapstructure:"label"`
+	Report      bool   `mapstructure:"report"`
+}
+
+type eosOverride struct {
+	Namespace string `mapstructure:"namespace"`
+	Letter    string `mapstructure:"letter"`
+	MGM       string `mapstructure:"mgm"`
+}
+
+type eosAlias struct {
+	Name string `mapstructure:"name"`
+	MGM  string `mapstructure:"mgm"`
+}
+
+type eosRewrite struct {
+	From string `mapstructure:"from"`
+	To   string `mapstructure:"to"`
+}
+
+var (
+	topology     *eosTopology
+	topologyOnce sync.Once
+)
+
+// getTopology returns the topology of the config, read once as it is used
+// for every space.
+func getTopology() *eosTopology {
+	topologyOnce.Do(func() {
+		topology = loadTopology()
+	})
+	return topology
+}
+
+func loadTopology() *eosTopology {
+	// keys are read one by one, as viper does not merge the defaults of a section set in the config
+	t := &eosTopology{
+		PrefixMGM:     viper.GetString("eos.prefix_mgm"),
+		AccountingMGM: viper.GetString("eos.accounting_mgm"),
+		AccountingDir: viper.GetString("eos.accounting_dir"),
+	}
+	lists := map[string]interface{}{
+		"eos.namespaces":      &t.Namespaces,
+		"eos.overrides":       &t.Overrides,
+		"eos.aliases":         &t.Aliases,
+		"eos.prefix_rewrites": &t.PrefixRewrites,
+	}
+	for key, v := range lists {
+		if err := viper.UnmarshalKey(key, v); err != nil {
+			er(fmt.Sprintf("error parsing %s: %+v", key, err))
+		}
+	}
+	for _, ns := range t.Namespaces {
+		if ns.Name == "" || ns.MGM == "" {
+			er(fmt.Sprintf("eos topology: namespaces need a name and a mgm: %+v", ns))
+		}
+	}
+	return t
+}
+
+func (ns *eosNamespace) letters() []string {
+	if !strings.Contains(ns.MGM+ns.Dir, "%s") {
+		return []string{""}
+	}
+	letters := ns.Letters
+	if letters == "" {
+		letters = "abcdefghijklmnopqrstuvwxyz"
+	}
+	return strings.Split(letters, "")
+}
+
+func (ns *eosNamespace) dir(letter string) string {
+	return strings.Replace(ns.Dir, "%s", letter, -1)
+}
+
+func (ns *eosNamespace) title() string {
+	return strings.ToUpper(ns.Name[:1]) + ns.Name[1:]
+}
+
+// chargeRole returns the charge role of a space of the namespace.
+func (ns *eosNamespace) chargeRole(p *projectInfo) string {
+	rule := ns.ChargeRole
+	if rule == "" {
+		rule = "CERNBox " + ns.title() + " {name}"
+	}
+	r := strings.NewReplacer(
+		"{name}", path.Base(p.FileInfo.File),
+		"{account}", p.userInfo.Account,
+		"{account_type}", p.userInfo.accountTypeHuman(),
+		"{namespace}", ns.Name,
+	)
+	return strings.TrimSpace(r.Replace(rule))
+}
+
+func (ns *eosNamespace) simpleRole() string {
+	if ns.SimpleRole == "" {
+		return "CERNBox " + ns.title() + " Spaces"
+	}
+	return ns.SimpleRole
+}
+
+func (ns *eosNamespace) label() string {
+	if ns.Label == "" {
+		return ns.title() + " space"
+	}
+	return ns.Label
+}
+
+// namespace returns the namespace called name or nil.
+func (t *eosTopology) namespace(name string) *eosNamespace {
+	for _, ns := range t.Namespaces {
+		if ns.Name == name {
+			return ns
+		}
+	}
+	return nil
+}
+
+// mgm returns the instance serving letter in ns.
+func (t *eosTopology) mgm(ns *eosNamespace, letter string) string {
+	for _, o := range t.Overrides {
+		if o.Namespace == ns.Name && o.Letter == letter {
+			return t.resolve(o.MGM)
+		}
+	}
+	return t.resolve(strings.Replace(ns.MGM, "%s", letter, -1))
+}
+
+// resolve applies the aliases to an instance.
+func (t *eosTopology) resolve(mgm string) string {
+	for _, a := range t.Aliases {
+		if a.Name == mgm {
+			return a.MGM
+		}
+	}
+	return mgm
+}
+
+// namespacesOf returns the namespaces served by mgm.
+func (t *eosTopology) namespacesOf(mgm string) []*eosNamespace {
+	namespaces := []*eosNamespace{}
+	for _, ns := range t.Namespaces {
+		for _, l := range ns.letters() {
+			if t.mgm(ns, l) == mgm {
+				namespaces = append(namespaces, ns)
+				break
+			}
+		}
+	}
+	return namespaces
+}
+
+// namespaceOfPath returns the namespace holding the space at file, or nil.
+func (t *eosTopology) namespaceOfPath(file string) *eosNamespace {
+	parent := path.Dir(path.Clean(file))
+	for _, ns := range t.Namespaces {
+		for _, l := range ns.letters() {
+			if parent == path.Clean(ns.dir(l)) {
+				return ns
+			}
+		}
+	}
+	return nil
+}
+
+// locate returns the namespace and letter of the instance storing file and
+// the root of the space containing it. ns is nil if file is outside the
+// topology.
+func (t *eosTopology) locate(file string) (ns *eosNamespace, letter, space string) {
+	file = path.Clean(file)
+	for _, ns := range t.Namespaces {
+		for _, l := range ns.letters() {
+			dir := path.Clean(ns.dir(l))
+			if !strings.HasPrefix(file, dir+"/") {
+				continue
+			}
+			name := strings.Split(strings.TrimPrefix(file, dir+"/"), "/")[0]
+			return ns, l, path.Join(dir, name)
+		}
+	}
+	return nil, "", ""
+}
+
+// reportNamespaces returns the namespaces to report: names if given,
+// otherwise the ones with report set, and home if userAlso is set.
+func (t *eosTopology) reportNamespaces(names []string, userAlso bool) ([]string, error) {
+	if len(names) > 0 {
+		for _, n := range names {
+			if t.namespace(n) == nil {
+				return nil, fmt.Errorf("namespace %q is not in the eos topology", n)
+			}
+		}
+		return names, nil
+	}
+
+	names = []string{}
+	for _, ns := range t.Namespaces {
+		if ns.Report || (userAlso && ns.Name == "home") {
+			names = append(names, ns.Name)
+		}
+	}
+	return names, nil
+}
+
+// homeMGM returns the instance of the home directory of username.
+func (t *eosTopology) homeMGM(username string) string {
+	ns := t.namespace("home")
+	if ns == nil {
+		er("eos topology: no home namespace")
+	}
+	return t.mgm(ns, string(username[0]))
+}
+
+// quotaPrefix returns the quota prefix of the namespace called name.
+func (t *eosTopology) quotaPrefix(name string) string {
+	ns := t.namespace(name)
+	if ns == nil {
+		er(fmt.Sprintf("eos topology: no %s namespace", name))
+	}
+	return ns.QuotaPrefix
+}
+
+// prefixName is the user friendly name of a fileid prefix.
+func (t *eosTopology) prefixName(prefix string) string {
+	for _, r := range t.PrefixRewrites {
+		prefix = strings.Replace(prefix, r.From, r.To, -1)
+	}
+	return prefix
+}
+
+// prefixMGM returns the instance of a fileid prefix as stored in oc_share.
+func (t *eosTopology) prefixMGM(prefix string) string {
+	return t.resolve(strings.Replace(t.PrefixMGM, "%s", t.prefixName(prefix), -1))
+}
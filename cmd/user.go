@@ -6,7 +6,10 @@ import (
 	"fmt"
 	"github.com/go-redis/redis"
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 	"gopkg.in/ldap.v3"
+	"path"
+	"sort"
 	"strconv"
 	"strings"
 )
@@ -71,8 +74,11 @@ var userGroupsCmd = &cobra.Command{
 }
 
 func getHomePath(username string) string {
-	letter := string(username[0])
-	return fmt.Sprintf("/eos/user/%s/%s", letter, username)
+	ns := getTopology().namespace("home")
+	if ns == nil {
+		er("eos topology: no home namespace")
+	}
+	return path.Join(ns.dir(string(username[0])), username)
 }
 
 func isMigrated(username string) bool {
@@ -100,6 +106,13 @@ func isMigrated(username string) bool {
 }
 
 func getUser(l *ldap.Conn, uid string) *userInfo {
+	ui, _ := lookupUser(l, uid)
+	return ui
+}
+
+// lookupUser is like getUser but reports search errors. An account that does
+// not exist is not an error, an empty userInfo is returned.
+func lookupUser(l *ldap.Conn, uid string) (*userInfo, error) {
 
 	// Search for the given username
 	searchTerm := fmt.Sprintf("(&(objectClass=user)(samaccountname=%s))", uid)
@@ -114,14 +127,18 @@ func getUser(l *ldap.Conn, uid string) *userInfo {
 
 	sr, err := l.Search(searchRequest)
 	if err != nil {
-		return newUserInfo()
+		return newUserInfo(), err
 	}
 
 	if len(sr.Entries) == 0 {
-		return newUserInfo()
+		return newUserInfo(), nil
 	}
 
-	entry := sr.Entries[0]
+	return userInfoFromEntry(sr.Entries[0]), nil
+}
+
+// userInfoFromEntry fills a userInfo with the attributes of an LDAP user.
+func userInfoFromEntry(entry *ldap.Entry) *userInfo {
 	ui := newUserInfo()
 	for _, attr := range entry.Attributes {
 		if attr.Name == "cn" {
@@ -163,18 +180,30 @@ func getUser(l *ldap.Conn, uid string) *userInfo {
 }
 
 func getUserFull(lc *ldap.Conn, uid string) *userInfo {
-	ui := getUser(lc, uid)
+	ui, _ := lookupUserFull(lc, uid)
+	return ui
+}
+
+// lookupUserFull is like getUserFull but reports search errors.
+func lookupUserFull(lc *ldap.Conn, uid string) (*userInfo, error) {
+	ui, err := lookupUser(lc, uid)
+	if err != nil {
+		return ui, err
+	}
 
 	// if account is service we get the owner details
 	if ui.AccountType == "Service" || ui.AccountType == "Secondary" {
 		cn := extractCN(ui.AccountOwnerDN)
-		owner := getUser(lc, cn)
+		owner, err := lookupUser(lc, cn)
 		ui.AccountOwner = owner
+		if err != nil {
+			return ui, err
+		}
 	} else if ui.AccountType == "Primary" {
 		ui.AccountOwner = ui
 	}
 
-	return ui
+	return ui, nil
 }
 
 // CN=gonzalhu,OU=Users,OU=Organic Units,DC=cern,DC=ch
@@ -210,58 +239,99 @@ func getUserGroups(uid string) []string {
 		for _, attr := range entry.Attributes {
 			if attr.Name == "tokenGroups" {
 				for _, binarySID := range attr.ByteValues {
-					numSubIDs, _ := strconv.ParseUint(fmt.Sprintf("%d", binarySID[1]), 16, 64)
-					auth, _ := strconv.ParseUint(fmt.Sprintf("%x", binarySID[2:8]), 16, 64)
-
-					sidObject := fmt.Sprintf("S-%x-%d", binarySID[0], auth)
-					//authorities := []uint32{}
-					for i := uint64(0); i < numSubIDs; i++ {
-						part := binarySID[8+4*i : 12+4*i]
-						a := binary.LittleEndian.Uint32(part)
-						sidObject += fmt.Sprintf("-%d", a)
-						//authorities = append(authorities, a)
-					}
-
-					//fmt.Printf("SID_RAW=%X SRL=%x NUM_SUB_ID=%d AUTH=%d AUTHORITIES=%+v SID=%s\n", binarySID, binarySID[0], numSubIDs, auth, authorities, sidObject)
-					sids = append(sids, sidObject)
+					sids = append(sids, decodeSID(binarySID))
 				}
 			}
 		}
 	}
 
-	groupsFilter := "(&(objectClass=Group)(|%s))"
-	var query string
-	for _, sid := range sids {
-		query += fmt.Sprintf("(objectSID=%s)", sid)
-	}
-	groupsFilter = fmt.Sprintf(groupsFilter, query)
-
-	searchRequest = ldap.NewSearchRequest(
-		"OU=e-groups,OU=Workgroups,DC=cern,DC=ch",
-		ldap.ScopeSingleLevel, ldap.NeverDerefAliases, 0, 0, false,
-		groupsFilter,
-		[]string{"cn"},
-		nil,
-	)
-
-	sr, err = l.SearchWithPaging(searchRequest, 1000000)
+	names, err := resolveSIDs(l, sids)
 	if err != nil {
 		er(err)
 	}
 
 	var gids []string
-	for _, entry := range sr.Entries {
-		for _, attr := range entry.Attributes {
-			if attr.Name == "cn" {
-				for _, cn := range attr.Values {
-					gids = append(gids, cn)
-				}
-			}
+	for _, sid := range sids {
+		if name := names[sid]; name != "" {
+			gids = append(gids, name)
 		}
 	}
+	sort.Strings(gids)
 	return gids
 }
 
+// decodeSID returns the string form (S-1-5-21-...) of a binary SID.
+func decodeSID(binarySID []byte) string {
+	if len(binarySID) < 8 {
+		return ""
+	}
+	numSubIDs, _ := strconv.ParseUint(fmt.Sprintf("%d", binarySID[1]), 16, 64)
+	auth, _ := strconv.ParseUint(fmt.Sprintf("%x", binarySID[2:8]), 16, 64)
+
+	sidObject := fmt.Sprintf("S-%x-%d", binarySID[0], auth)
+	for i := uint64(0); i < numSubIDs && len(binarySID) >= int(12+4*i); i++ {
+		part := binarySID[8+4*i : 12+4*i]
+		a := binary.LittleEndian.Uint32(part)
+		sidObject += fmt.Sprintf("-%d", a)
+	}
+	return sidObject
+}
+
+// resolveSIDs returns the e-group names of sids, using the cache. SIDs not
+// cached are searched in batches of ldap_sid_batch, as a single filter with
+// all the groups of a user can exceed the limits of the server. SIDs that are
+// not e-groups map to an empty name.
+func resolveSIDs(l *ldap.Conn, sids []string) (map[string]string, error) {
+	names := make(map[string]string, len(sids))
+	missing := []string{}
+	for _, sid := range sids {
+		var name string
+		if getCache().get(cacheBucketSID, sid, &name) {
+			names[sid] = name
+		} else {
+			missing = append(missing, sid)
+		}
+	}
+
+	batch := viper.GetInt("ldap_sid_batch")
+	if batch < 1 {
+		batch = 1
+	}
+	for start := 0; start < len(missing); start += batch {
+		end := start + batch
+		if end > len(missing) {
+			end = len(missing)
+		}
+		chunk := missing[start:end]
+
+		var query string
+		for _, sid := range chunk {
+			query += fmt.Sprintf("(objectSID=%s)", sid)
+		}
+		searchRequest := ldap.NewSearchRequest(
+			"OU=e-groups,OU=Workgroups,DC=cern,DC=ch",
+			ldap.ScopeSingleLevel, ldap.NeverDerefAliases, 0, 0, false,
+			fmt.Sprintf("(&(objectClass=Group)(|%s))", query),
+			[]string{"cn", "objectSid"},
+			nil,
+		)
+		sr, err := l.SearchWithPaging(searchRequest, 1000)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range sr.Entries {
+			names[decodeSID(entry.GetRawAttributeValue("objectSid"))] = entry.GetAttributeValue("cn")
+		}
+
+		found := make(map[string]interface{}, len(chunk))
+		for _, sid := range chunk {
+			found[sid] = names[sid]
+		}
+		getCache().setMany(cacheBucketSID, found)
+	}
+	return names, nil
+}
+
 func newUserInfo() *userInfo {
 	return &userInfo{
 		AccountOwner: &userInfo{},
@@ -0,0 +1,174 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"github.com/spf13/cobra"
+	"gopkg.in/ldap.v3"
+	"sort"
+	"strings"
+	"time"
+)
+
+func init() {
+	userCmd.AddCommand(userAccountsCmd)
+}
+
+var userAccountsCmd = &cobra.Command{
+	Use:   "accounts <username>",
+	Short: "Shows the secondary and service accounts of a person with their home directory, quota, projects and shares",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 1 {
+			exit(cmd)
+		}
+
+		username := strings.TrimSpace(args[0])
+		lc := getLDAP()
+		defer lc.Close()
+
+		ui := getUserFull(lc, username)
+		if ui.Account == "" {
+			er(fmt.Sprintf("account %q not found", username))
+		}
+		// start from the person owning the account
+		root := ui
+		if ui.AccountType != "Primary" && ui.AccountOwner != nil && ui.AccountOwner.Account != "" {
+			fmt.Printf("%s is a %s account of %s\n\n", ui.Account, strings.ToLower(ui.AccountType), ui.AccountOwner.Account)
+			root = ui.AccountOwner
+		}
+
+		tree, err := getAccountTree(lc, root, map[string]bool{})
+		if err != nil {
+			er(err)
+		}
+
+		projects := map[string][]string{} // service account => project names
+		for _, p := range getProjectSpaces("") {
+			projects[p.owner] = append(projects[p.owner], p.name)
+		}
+
+		printAccountTree(tree, projects, "", "")
+	},
+}
+
+// accountNode is an account and the accounts it owns.
+type accountNode struct {
+	info  *userInfo
+	owned []*accountNode
+}
+
+// getAccountTree finds recursively the accounts whose cernAccountOwner is ui.
+// seen guards against ownership cycles.
+func getAccountTree(l *ldap.Conn, ui *userInfo, seen map[string]bool) (*accountNode, error) {
+	node := &accountNode{info: ui}
+	seen[ui.Account] = true
+
+	owned, err := searchOwnedAccounts(l, ui.Account)
+	if err != nil {
+		return nil, err
+	}
+	for _, o := range owned {
+		if seen[o.Account] {
+			continue
+		}
+		child, err := getAccountTree(l, o, seen)
+		if err != nil {
+			return nil, err
+		}
+		node.owned = append(node.owned, child)
+	}
+	return node, nil
+}
+
+// searchOwnedAccounts returns the accounts owned by account, sorted by type
+// and name.
+func searchOwnedAccounts(l *ldap.Conn, account string) ([]*userInfo, error) {
+	ownerDN := fmt.Sprintf("CN=%s,OU=Users,OU=Organic Units,DC=cern,DC=ch", account)
+	searchRequest := ldap.NewSearchRequest(
+		"OU=Users,OU=Organic Units,DC=cern,DC=ch",
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+		fmt.Sprintf("(&(objectClass=user)(cernAccountOwner=%s))", ldap.EscapeFilter(ownerDN)),
+		[]string{},
+		nil,
+	)
+	sr, err := l.SearchWithPaging(searchRequest, 1000)
+	if err != nil {
+		return nil, err
+	}
+
+	accounts := []*userInfo{}
+	for _, entry := range sr.Entries {
+		ui := userInfoFromEntry(entry)
+		if ui.Account != "" && ui.Account != account {
+			accounts = append(accounts, ui)
+		}
+	}
+	sort.Slice(accounts, func(i, j int) bool {
+		if accounts[i].AccountType != accounts[j].AccountType {
+			return accounts[i].AccountType < accounts[j].AccountType
+		}
+		return accounts[i].Account < accounts[j].Account
+	})
+	return accounts, nil
+}
+
+func printAccountTree(node *accountNode, projects map[string][]string, prefix, branch string) {
+	ui := node.info
+	fmt.Printf("%s%s%s (%s) %s\n", prefix, branch, ui.Account, ui.AccountType, ui.Name)
+
+	details := prefix
+	switch branch {
+	case "├── ":
+		details += "│   "
+	case "└── ":
+		details += "    "
+	}
+	for _, line := range accountDetails(ui.Account, projects[ui.Account]) {
+		fmt.Printf("%s  %s\n", details, line)
+	}
+
+	for i, child := range node.owned {
+		b := "├── "
+		if i == len(node.owned)-1 {
+			b = "└── "
+		}
+		printAccountTree(child, projects, details, b)
+	}
+}
+
+// accountDetails describes the CERNBox footprint of an account: home
+// directory and quota usage, projects where it is the service account and
+// shares given.
+func accountDetails(account string, projects []string) []string {
+	lines := []string{}
+
+	home := getHomePath(account)
+	ctx, cancel := context.WithTimeout(getCtx(), time.Second*60)
+	defer cancel()
+	eos := getEOSForUser(account)
+	if _, err := eos.GetFileInfoByPath(ctx, "root", home); err != nil {
+		lines = append(lines, fmt.Sprintf("home: %s (not found)", home))
+	} else if q, err := eos.GetQuota(ctx, account, getTopology().quotaPrefix("home")); err != nil {
+		lines = append(lines, fmt.Sprintf("home: %s (quota unknown)", home))
+	} else {
+		lines = append(lines, fmt.Sprintf("home: %s %s of %s used", home, humanQuota(q.UsedBytes), humanQuota(q.AvailableBytes)))
+	}
+
+	if len(projects) > 0 {
+		sort.Strings(projects)
+		lines = append(lines, fmt.Sprintf("projects: %s", strings.Join(projects, ", ")))
+	}
+
+	shares, err := getSharesByOwner(account)
+	if err != nil {
+		er(err)
+	}
+	links := 0
+	for _, s := range shares {
+		if s.ShareType == 3 {
+			links++
+		}
+	}
+	lines = append(lines, fmt.Sprintf("shares: %d, public links: %d", len(shares)-links, links))
+	return lines
+}
@@ -0,0 +1,404 @@
+package cmd
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/cs3org/reva/pkg/eosclient"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"os"
+	"os/user"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+func init() {
+	viper.SetDefault("offboard_audit_log", "/var/lib/cernboxcop/offboard-audit.log")
+	viper.SetDefault("archive_attr", "cernbox.archive")
+
+	userCmd.AddCommand(userOffboardCmd)
+
+	userOffboardCmd.Flags().Bool("revoke-links", false, "revokes the public links of the account")
+	userOffboardCmd.Flags().Bool("transfer-project-shares", false, "transfers the shares on project spaces to the account given with --to")
+	userOffboardCmd.Flags().Bool("archive-home", false, "flags the home directory for archival with the archive_attr extended attribute")
+	userOffboardCmd.Flags().String("to", "", "new owner of the shares on project spaces, must be admin of the projects")
+	userOffboardCmd.Flags().BoolP("yes", "y", false, "executes the selected actions without confirmation")
+}
+
+var userOffboardCmd = &cobra.Command{
+	Use:   "offboard <username>",
+	Short: "Shows everything a departed account owns and a handover plan, and executes the selected actions",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 1 {
+			exit(cmd)
+		}
+
+		username := strings.TrimSpace(args[0])
+		if username == "" {
+			exit(cmd)
+		}
+		revokeLinks, _ := cmd.Flags().GetBool("revoke-links")
+		transferShares, _ := cmd.Flags().GetBool("transfer-project-shares")
+		archiveHome, _ := cmd.Flags().GetBool("archive-home")
+		to, _ := cmd.Flags().GetString("to")
+		yes, _ := cmd.Flags().GetBool("yes")
+
+		to = strings.TrimSpace(to)
+		if transferShares && to == "" {
+			er("--transfer-project-shares needs the new owner in --to")
+		}
+
+		fp := getFootprint(username)
+		fp.print()
+
+		plan := fp.plan(to)
+		selected := map[string]bool{
+			offboardRevokeLink:    revokeLinks,
+			offboardTransferShare: transferShares,
+			offboardArchiveHome:   archiveHome,
+		}
+		fmt.Println("\nHandover plan")
+		printOffboardPlan(plan, selected)
+
+		todo := []*offboardAction{}
+		for _, a := range plan {
+			if selected[a.kind] && a.run != nil {
+				todo = append(todo, a)
+			}
+		}
+		if len(todo) == 0 {
+			return
+		}
+
+		if !yes {
+			msg := fmt.Sprintf("Are you sure to execute %d actions for %q?\n", len(todo), username)
+			if !askForConfirmation(msg) {
+				fmt.Fprintf(os.Stderr, "Aborted\n")
+				os.Exit(1)
+			}
+		}
+
+		db := getDB()
+		defer db.Close()
+		audit := runOffboardActions(db, username, todo)
+		fmt.Println("\nAudit")
+		cols := []string{"TIME", "ACTION", "TARGET", "RESULT", "ERROR"}
+		rows := [][]string{}
+		for _, e := range audit {
+			rows = append(rows, []string{e.Time.Local().Format("2006-01-02 15:04:05"), e.Action, e.Target, e.Result, e.Error})
+		}
+		pretty(cols, rows)
+	},
+}
+
+// footprint is everything an account owns in CERNBox.
+type footprint struct {
+	account        string
+	info           *userInfo
+	home           string
+	homeFound      bool
+	homeSize       string
+	quota          *eosclient.QuotaInfo
+	projects       []*footprintProject
+	sharesGiven    []*dbShare
+	sharesReceived []*dbShare
+	links          []*dbShare
+}
+
+type footprintProject struct {
+	project *projectSpace
+	role    string
+}
+
+var projectAdminGroupRegexp = regexp.MustCompile(`^cernbox-project-(.+)-admins$`)
+
+// getFootprint gathers the home directory, projects and shares of username.
+// Missing information is reported but does not stop the gathering, as the
+// account may already be gone from LDAP or EOS.
+func getFootprint(username string) *footprint {
+	fp := &footprint{account: username, home: getHomePath(username), homeSize: "-"}
+
+	lc := getLDAP()
+	fp.info = getUserFull(lc, username)
+	lc.Close()
+
+	ctx, cancel := context.WithTimeout(getCtx(), time.Second*60)
+	defer cancel()
+	eos := getEOSForUser(username)
+	if fi, err := eos.GetFileInfoByPath(ctx, "root", fp.home); err == nil {
+		fp.homeFound, fp.homeSize = true, humanQuota(int(fi.TreeSize))
+	} else {
+		fmt.Fprintf(os.Stderr, "Warning: cannot stat home directory %s: %v\n", fp.home, err)
+	}
+	if q, err := eos.GetQuota(ctx, username, getTopology().quotaPrefix("home")); err == nil {
+		fp.quota = q
+	} else {
+		fmt.Fprintf(os.Stderr, "Warning: cannot get the quota of %s: %v\n", username, err)
+	}
+
+	for _, p := range getProjectSpaces(username) {
+		fp.projects = append(fp.projects, &footprintProject{project: p, role: "service-account"})
+	}
+	if fp.info.Account != "" {
+		var projects []*projectSpace
+		for _, g := range getUserGroups(username) {
+			m := projectAdminGroupRegexp.FindStringSubmatch(g)
+			if m == nil {
+				continue
+			}
+			if projects == nil {
+				projects = getProjectSpaces("")
+			}
+			if p, err := findProject(projects, m[1]); err == nil {
+				fp.projects = append(fp.projects, &footprintProject{project: p, role: "admin"})
+			}
+		}
+	}
+
+	given, err := getSharesByOwner(username)
+	if err != nil {
+		er(err)
+	}
+	for _, s := range given {
+		if s.ShareType == 3 {
+			fp.links = append(fp.links, s)
+		} else {
+			fp.sharesGiven = append(fp.sharesGiven, s)
+		}
+	}
+	if fp.sharesReceived, err = getSharesByWith(username); err != nil {
+		er(err)
+	}
+	return fp
+}
+
+func (fp *footprint) print() {
+	if fp.info.Account != "" {
+		prettyUser(fp.info)
+	} else {
+		fmt.Printf("%s is not in LDAP\n", fp.account)
+	}
+
+	fmt.Println("\nHome directory")
+	used, available := "-", "-"
+	if fp.quota != nil {
+		used, available = humanQuota(fp.quota.UsedBytes), humanQuota(fp.quota.AvailableBytes)
+	}
+	pretty([]string{"PATH", "SIZE", "QUOTAUSED", "QUOTA"}, [][]string{{fp.home, fp.homeSize, used, available}})
+
+	fmt.Println("\nProjects")
+	rows := [][]string{}
+	for _, p := range fp.projects {
+		rows = append(rows, []string{p.project.name, p.project.rel, p.role})
+	}
+	pretty([]string{"NAME", "PATH", "ROLE"}, rows)
+
+	fmt.Println("\nShares given")
+	rows = [][]string{}
+	for _, s := range fp.sharesGiven {
+		rows = append(rows, []string{fmt.Sprintf("%d", s.ID), s.HumanType(), s.HumanShareWith(), s.HumanPerm(), s.HumanSTime(), s.FileID()})
+	}
+	pretty([]string{"ID", "TYPE", "SHARE_WITH", "PERMISSION", "CREATED", "FILEID"}, rows)
+
+	fmt.Println("\nShares received")
+	rows = [][]string{}
+	for _, s := range fp.sharesReceived {
+		rows = append(rows, []string{fmt.Sprintf("%d", s.ID), s.UIDOwner, s.HumanPerm(), s.HumanSTime(), s.FileID()})
+	}
+	pretty([]string{"ID", "OWNER", "PERMISSION", "CREATED", "FILEID"}, rows)
+
+	fmt.Println("\nPublic links")
+	cols, rows := linkRows(fp.links, false)
+	pretty(cols, rows)
+}
+
+// Kinds of offboarding actions.
+const (
+	offboardRevokeLink    = "revoke-link"
+	offboardTransferShare = "transfer-share"
+	offboardArchiveHome   = "archive-home"
+	offboardManual        = "manual" // needs a human decision, not executed
+)
+
+type offboardAction struct {
+	kind   string
+	target string
+	detail string
+	run    func(db *sql.DB) error // nil for actions that cannot be executed
+}
+
+// plan proposes the actions to hand over what the account owns. Shares on
+// project spaces go to newOwner if given.
+func (fp *footprint) plan(newOwner string) []*offboardAction {
+	plan := []*offboardAction{}
+
+	for _, l := range fp.links {
+		token := l.Token
+		plan = append(plan, &offboardAction{kind: offboardRevokeLink, target: token, detail: l.FileID(), run: func(db *sql.DB) error {
+			return execOneShareStmt(db, "delete from oc_share where share_type=3 and token=?", token)
+		}})
+	}
+
+	t := getTopology()
+	var projects []*projectSpace            // loaded on first use
+	projectOf := map[string]*projectSpace{} // space => project, nil if not found
+	admins := map[string]bool{}             // project name => newOwner is admin
+	for _, s := range fp.sharesGiven {
+		target := fmt.Sprintf("share %d", s.ID)
+		if !strings.Contains(s.Prefix, "project") {
+			plan = append(plan, &offboardAction{kind: offboardManual, target: target, detail: "share on the home directory, move the data and use sharing transfer-user"})
+			continue
+		}
+		if newOwner == "" {
+			plan = append(plan, &offboardAction{kind: offboardTransferShare, target: target, detail: "share on a project space, choose the new owner with --to"})
+			continue
+		}
+
+		file := s.GetPath()
+		if file == "-" {
+			plan = append(plan, &offboardAction{kind: offboardManual, target: target, detail: "the shared file cannot be found"})
+			continue
+		}
+		_, _, space := t.locate(file)
+		project, ok := projectOf[space]
+		if !ok && space != "" {
+			if projects == nil {
+				projects = getProjectSpaces("")
+			}
+			project, _ = findProject(projects, space)
+			projectOf[space] = project
+		}
+		if project == nil {
+			plan = append(plan, &offboardAction{kind: offboardManual, target: target, detail: "the project of the shared file cannot be found"})
+			continue
+		}
+		isAdmin, ok := admins[project.name]
+		if !ok {
+			isAdmin = isProjectAdmin(newOwner, project)
+			admins[project.name] = isAdmin
+		}
+		if !isAdmin {
+			plan = append(plan, &offboardAction{kind: offboardManual, target: target, detail: fmt.Sprintf("%s is not in %s", newOwner, projectAdminGroup(project))})
+			continue
+		}
+		id := s.ID
+		plan = append(plan, &offboardAction{kind: offboardTransferShare, target: target, detail: fmt.Sprintf("to %s in project %s", newOwner, project.name), run: func(db *sql.DB) error {
+			return execOneShareStmt(db, "update oc_share set uid_owner=? where id=?", newOwner, id)
+		}})
+	}
+
+	for _, p := range fp.projects {
+		if p.role == "service-account" {
+			plan = append(plan, &offboardAction{kind: offboardManual, target: "project " + p.project.name, detail: "choose a new service account with project update-svc-account"})
+		}
+	}
+
+	if fp.homeFound {
+		home, account := fp.home, fp.account
+		plan = append(plan, &offboardAction{kind: offboardArchiveHome, target: home, detail: fmt.Sprintf("sets %s", archiveAttr()), run: func(*sql.DB) error {
+			ctx, cancel := context.WithTimeout(getCtx(), time.Second*60)
+			defer cancel()
+			attr := &eosclient.Attribute{Type: eosclient.SystemAttr, Key: viper.GetString("archive_attr"), Val: time.Now().Format("2006-01-02")}
+			return getEOSForUser(account).SetAttr(ctx, "root", attr, false, home)
+		}})
+	}
+
+	sort.SliceStable(plan, func(i, j int) bool {
+		return plan[i].kind < plan[j].kind
+	})
+	return plan
+}
+
+// execOneShareStmt runs a statement modifying a single row of oc_share in a
+// transaction, rolled back if the statement does not change exactly one row.
+func execOneShareStmt(db *sql.DB, query string, args ...interface{}) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	res, err := tx.Exec(query, args...)
+	var n int64
+	if err == nil {
+		n, err = res.RowsAffected()
+	}
+	if err == nil && n != 1 {
+		err = fmt.Errorf("%d shares changed instead of 1", n)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func archiveAttr() string {
+	return "sys." + viper.GetString("archive_attr")
+}
+
+func printOffboardPlan(plan []*offboardAction, selected map[string]bool) {
+	cols := []string{"ACTION", "TARGET", "DETAIL", "SELECTED"}
+	rows := [][]string{}
+	for _, a := range plan {
+		sel := "no"
+		if a.run == nil {
+			sel = "-"
+		} else if selected[a.kind] {
+			sel = "yes"
+		}
+		rows = append(rows, []string{a.kind, a.target, a.detail, sel})
+	}
+	pretty(cols, rows)
+}
+
+// offboardAudit is an executed offboarding action, appended as a JSON line
+// to offboard_audit_log.
+type offboardAudit struct {
+	Time     time.Time
+	Operator string
+	Account  string
+	Action   string
+	Target   string
+	Result   string
+	Error    string `json:",omitempty"`
+}
+
+// runOffboardActions executes the actions, continuing after failures, and
+// records every result in the audit log.
+func runOffboardActions(db *sql.DB, account string, actions []*offboardAction) []*offboardAudit {
+	operator := ""
+	if u, err := user.Current(); err == nil {
+		operator = u.Username
+	}
+
+	file := viper.GetString("offboard_audit_log")
+	os.MkdirAll(path.Dir(file), 0755)
+	fd, err := os.OpenFile(file, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		er(fmt.Sprintf("error opening audit log %s: %+v", file, err))
+	}
+	defer fd.Close()
+	enc := json.NewEncoder(fd)
+
+	audit := []*offboardAudit{}
+	for _, a := range actions {
+		e := &offboardAudit{Operator: operator, Account: account, Action: a.kind, Target: a.target, Result: "done"}
+		if err := a.run(db); err != nil {
+			e.Result, e.Error = "failed", err.Error()
+			log.Error().Msgf("offboarding action failed: account:%s action:%s target:%s err:%+v", account, a.kind, a.target, err)
+		} else {
+			log.Info().Msgf("offboarding action done: account:%s action:%s target:%s", account, a.kind, a.target)
+		}
+		e.Time = time.Now()
+		if err := enc.Encode(e); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing audit log %s: %v\n", file, err)
+		}
+		audit = append(audit, e)
+	}
+	return audit
+}
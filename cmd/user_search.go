@@ -0,0 +1,120 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+	"gopkg.in/ldap.v3"
+	"os"
+	"sort"
+	"strings"
+)
+
+func init() {
+	userCmd.AddCommand(userSearchCmd)
+
+	userSearchCmd.Flags().StringP("mail", "m", "", "mail address")
+	userSearchCmd.Flags().StringP("name", "n", "", "part of the display name")
+	userSearchCmd.Flags().StringP("department", "d", "", "department, e.g. IT")
+	userSearchCmd.Flags().StringP("group", "g", "", "group, e.g. ST")
+	userSearchCmd.Flags().StringP("section", "s", "", "section, e.g. AD")
+	userSearchCmd.Flags().StringP("type", "t", "", "account type: Primary, Secondary or Service")
+	userSearchCmd.Flags().IntP("limit", "l", 100, "returns at most <n> accounts. 0 means all")
+}
+
+var userSearchCmd = &cobra.Command{
+	Use:   "search",
+	Short: "Searches accounts by mail, display name, department, group, section or account type",
+	Run: func(cmd *cobra.Command, args []string) {
+		criteria := &userSearchCriteria{}
+		criteria.mail, _ = cmd.Flags().GetString("mail")
+		criteria.name, _ = cmd.Flags().GetString("name")
+		criteria.department, _ = cmd.Flags().GetString("department")
+		criteria.group, _ = cmd.Flags().GetString("group")
+		criteria.section, _ = cmd.Flags().GetString("section")
+		criteria.accountType, _ = cmd.Flags().GetString("type")
+		limit, _ := cmd.Flags().GetInt("limit")
+
+		filter := criteria.filter()
+		if filter == "" {
+			exit(cmd)
+		}
+
+		lc := getLDAP()
+		defer lc.Close()
+
+		users, err := searchUsers(lc, filter, limit)
+		if err != nil {
+			if !ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+				er(err)
+			}
+			fmt.Fprintf(os.Stderr, "Warning: more than %d accounts match, use --limit to see more\n", limit)
+		}
+		prettyUser(users...)
+	},
+}
+
+type userSearchCriteria struct {
+	mail, name, department, group, section, accountType string
+}
+
+// filter returns the LDAP filter matching all the criteria given, or an
+// empty string if there are none.
+func (c *userSearchCriteria) filter() string {
+	var terms []string
+	add := func(attr, value string, substring bool) {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			return
+		}
+		value = ldap.EscapeFilter(value)
+		if substring {
+			value = "*" + value + "*"
+		}
+		terms = append(terms, fmt.Sprintf("(%s=%s)", attr, value))
+	}
+	add("mail", c.mail, false)
+	add("displayName", c.name, true)
+	add("division", c.department, false)
+	add("cernGroup", c.group, false)
+	add("cernSection", c.section, false)
+	add("cernAccountType", c.accountType, false)
+
+	if len(terms) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("(&(objectClass=user)%s)", strings.Join(terms, ""))
+}
+
+// searchUsers returns the accounts matching filter, sorted by account name.
+// If more than limit accounts match, the first ones are returned with an
+// LDAPResultSizeLimitExceeded error.
+func searchUsers(l *ldap.Conn, filter string, limit int) ([]*userInfo, error) {
+	if limit < 0 {
+		limit = 0
+	}
+	searchRequest := ldap.NewSearchRequest(
+		"OU=Users,OU=Organic Units,DC=cern,DC=ch",
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, limit, 0, false,
+		filter,
+		[]string{},
+		nil,
+	)
+
+	// pages of at most limit entries, so the entries received before the
+	// limit is exceeded are kept
+	pageSize := uint32(500)
+	if limit > 0 && limit < 500 {
+		pageSize = uint32(limit)
+	}
+	sr, err := l.SearchWithPaging(searchRequest, pageSize)
+	users := []*userInfo{}
+	if sr != nil {
+		for _, entry := range sr.Entries {
+			users = append(users, userInfoFromEntry(entry))
+		}
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Account < users[j].Account
+	})
+	return users, err
+}